@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// Config is read from config.json in the data directory.
+// The file is optional and every field has a reasonable default
+// so that running locally doesn't require any setup
+type Config struct {
+	// if formatting Go code locally fails for reasons other than
+	// errors in the source code (e.g. go toolchain is not installed)
+	// we retry with play.golang.org/fmt
+	GoFmtUpstreamFallback bool
+
+	// "upstream" (default) runs Go code on play.golang.org
+	// "local" builds and runs it with local go toolchain
+	// can be over-ridden with -go-run-backend flag
+	GoRunBackend string
+	// limits for "local" backend, 0 means use the default
+	GoRunTimeoutSec  int
+	GoRunCPUSec      int
+	GoRunMemoryMB    int
+	GoRunMaxOutputKB int
+	// additional local toolchains that can be selected with ?go=${name}
+	// maps name (e.g. "go1.21", "gotip") to GOROOT directory of the toolchain
+	// "go" in PATH is used by default
+	GoToolchains map[string]string
+
+	// how many results of running Go code to cache
+	// 0 means default, -1 disables caching
+	GoRunCacheSize int
+	// if true, cached results are also saved in data dir and survive restarts
+	GoRunCachePersist bool
+
+	// how many /api/goplay/ requests a single client can make per minute
+	// and how many at once, 0 means use the default
+	GoPlayRatePerMinute int
+	GoPlayRateBurst     int
+	// how many programs can be built and run at the same time
+	// (default is number of cpus) and how many can wait for their turn
+	GoRunMaxConcurrent int
+	GoRunMaxQueue      int
+
+	// max time of fuzzing with /api/goplay/fuzz, 0 means default of 60 seconds
+	GoFuzzMaxTimeSec int
+
+	// max size of compiled .wasm files kept in data dir, 0 means default of 256 MB
+	GoWasmCacheMB int
+
+	// max total size of snippets shared with /api/goplay/share, 0 means
+	// default of 256 MB. When full, sharing new snippets fails
+	GoSnippetsMaxMB int
+
+	// if set, Go snippets can import third-party modules which are downloaded
+	// with this GOPROXY e.g. "https://proxy.golang.org" or a local directory
+	// with modules in GOPROXY layout e.g. "/srv/goproxy"
+	GoProxy string
+	// GOSUMDB used with GoProxy, default is "off"
+	GoSumDB string
+	// max size of the module cache in data dir, 0 means default of 1 GB
+	GoModCacheMB int
+
+	// maps Edna block language (e.g. "python") to a local command that runs it
+	// e.g. {"python": {"Command": ["python3", "${file}"], "FileName": "main.py"}}
+	Runners map[string]*RunnerConfig
+	// directories that programs run by "local" backend and Runners can read,
+	// in addition to /usr, /bin, /lib etc. e.g. where an interpreter is installed
+	RunSandboxDirs []string
+
+	// maps Edna block language to a language server for /api/lsp/${lang}
+	// gopls is used for "golang" if it's installed
+	LanguageServers map[string]*LanguageServerConfig
+
+	// currency rate providers in the order they're tried, default is
+	// ["open.er-api", "ecb", "fixer"]. fixer requires FIXER_API_KEY secret
+	CurrencyProviders []string
+	// if set, /api/currency_rates/${YYYY-MM-DD} gets rates for days we don't
+	// have from this provider, "ecb" or "fixer"
+	CurrencyHistoryProvider string
+	// if set, rates of crypto assets from this provider ("coingecko") are
+	// added to currency rates
+	CryptoProvider string
+	// maps unit name to coingecko id e.g. {"BTC": "bitcoin"}, default
+	// has the most popular assets
+	CryptoAssets map[string]string
+
+	// admin calls (e.g. purging caches) must send "Authorization: Bearer ${AdminToken}"
+	// if empty, admin calls are disabled
+	AdminToken string
+}
+
+var (
+	config = &Config{}
+)
+
+func getConfigPath() string {
+	return filepath.Join(getDataDirMust(), "config.json")
+}
+
+func loadConfig() {
+	path := getConfigPath()
+	d, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logf("loadConfig: '%s' doesn't exist, using defaults\n", path)
+			return
+		}
+		panicIfErr(err)
+	}
+	c := &Config{}
+	err = json.Unmarshal(d, c)
+	panicIf(err != nil, "loadConfig: failed to parse '%s': %s", path, err)
+	config = c
+	logf("loadConfig: loaded '%s'\n", path)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CurrencyRates is what /api/currency_rates.json returns, in the shape
+// currency.js expects: value of 1 unit of base currency in other currencies.
+// It's the same as the response of open.er-api.com with added info about
+// where the rates came from
+type CurrencyRates struct {
+	Base  string             `json:"base_code"`
+	Rates map[string]float64 `json:"rates"`
+	// when the provider updated the rates
+	TimeLastUpdateUnix int64 `json:"time_last_update_unix"`
+	// name of the provider that returned the rates
+	Provider string `json:"provider"`
+	// when we got the rates from the provider
+	TimeFetchedUnix int64 `json:"time_fetched_unix"`
+	// YYYY-MM-DD, only in historical rates, the day the rates are for
+	Date string `json:"date,omitempty"`
+}
+
+// currencyProvider is a source of currency rates
+type currencyProvider interface {
+	Name() string
+	// returns rates normalized to CurrencyRates, Provider and
+	// TimeFetchedUnix are set by the caller
+	Fetch() (*CurrencyRates, error)
+}
+
+// https://www.exchangerate-api.com/docs/free, rate limited, updates rates once a day
+type openERAPIProvider struct {
+	up *upstream
+}
+
+func (p *openERAPIProvider) Name() string {
+	return "open.er-api"
+}
+
+func (p *openERAPIProvider) Fetch() (*CurrencyRates, error) {
+	d, err := getCurrencyProviderData(p.up, "https://open.er-api.com/v6/latest/EUR")
+	if err != nil {
+		return nil, err
+	}
+	var rsp struct {
+		Result             string             `json:"result"`
+		ErrorType          string             `json:"error-type"`
+		BaseCode           string             `json:"base_code"`
+		Rates              map[string]float64 `json:"rates"`
+		TimeLastUpdateUnix int64              `json:"time_last_update_unix"`
+	}
+	err = json.Unmarshal(d, &rsp)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.Result != "success" {
+		return nil, e("result: '%s', error: '%s'", rsp.Result, rsp.ErrorType)
+	}
+	return &CurrencyRates{
+		Base:               rsp.BaseCode,
+		Rates:              rsp.Rates,
+		TimeLastUpdateUnix: rsp.TimeLastUpdateUnix,
+	}, nil
+}
+
+// daily reference rates of European Central Bank, for ~30 currencies,
+// updated around 16:00 CET on working days
+// https://www.ecb.europa.eu/stats/policy_and_exchange_rates/euro_reference_exchange_rates/html/index.en.html
+type ecbProvider struct {
+	up *upstream
+}
+
+func (p *ecbProvider) Name() string {
+	return "ecb"
+}
+
+// ecbRates is eurofxref-daily.xml:
+// <gesmes:Envelope><Cube><Cube time="2024-05-10"><Cube currency="USD" rate="1.0772"/>...
+type ecbRates struct {
+	Days []struct {
+		Time  string `xml:"time,attr"`
+		Rates []struct {
+			Currency string `xml:"currency,attr"`
+			Rate     string `xml:"rate,attr"`
+		} `xml:"Cube"`
+	} `xml:"Cube>Cube"`
+}
+
+func (p *ecbProvider) Fetch() (*CurrencyRates, error) {
+	d, err := getCurrencyProviderData(p.up, "https://www.ecb.europa.eu/stats/eurofxref/eurofxref-daily.xml")
+	if err != nil {
+		return nil, err
+	}
+	days, err := parseECBRates(d)
+	if err != nil {
+		return nil, err
+	}
+	return days[0], nil
+}
+
+// FetchHistory returns rates for all days since 1999. It's a large
+// file so if date is recent we get only the last 90 days
+func (p *ecbProvider) FetchHistory(date time.Time) ([]*CurrencyRates, error) {
+	uri := "https://www.ecb.europa.eu/stats/eurofxref/eurofxref-hist.xml"
+	if time.Since(date) < 80*24*time.Hour {
+		uri = "https://www.ecb.europa.eu/stats/eurofxref/eurofxref-hist-90d.xml"
+	}
+	d, err := getCurrencyProviderData(p.up, uri)
+	if err != nil {
+		return nil, err
+	}
+	return parseECBRates(d)
+}
+
+// parseECBRates returns rates for every day in the response, latest first
+func parseECBRates(d []byte) ([]*CurrencyRates, error) {
+	var rsp ecbRates
+	err := xml.Unmarshal(d, &rsp)
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp.Days) == 0 {
+		return nil, errors.New("no rates in the response")
+	}
+	var res []*CurrencyRates
+	for _, day := range rsp.Days {
+		t, err := time.Parse(time.DateOnly, day.Time)
+		if err != nil {
+			return nil, err
+		}
+		rates := &CurrencyRates{
+			Base:  "EUR",
+			Rates: map[string]float64{"EUR": 1},
+			// rates are published at 16:00 CET
+			TimeLastUpdateUnix: t.Add(15 * time.Hour).Unix(),
+			Date:               day.Time,
+		}
+		for _, r := range day.Rates {
+			v, err := strconv.ParseFloat(r.Rate, 64)
+			if err != nil {
+				return nil, e("invalid rate '%s' of '%s'", r.Rate, r.Currency)
+			}
+			rates.Rates[r.Currency] = v
+		}
+		res = append(res, rates)
+	}
+	return res, nil
+}
+
+// https://fixer.io/documentation, free plan has 100 requests per month
+// and only supports EUR as base currency. Requires FIXER_API_KEY secret
+type fixerProvider struct {
+	up *upstream
+}
+
+func (p *fixerProvider) Name() string {
+	return "fixer"
+}
+
+func (p *fixerProvider) Fetch() (*CurrencyRates, error) {
+	return p.fetch("latest")
+}
+
+// FetchHistory returns rates for a single day
+func (p *fixerProvider) FetchHistory(date time.Time) ([]*CurrencyRates, error) {
+	rates, err := p.fetch(date.Format(time.DateOnly))
+	if err != nil {
+		return nil, err
+	}
+	rates.Date = date.Format(time.DateOnly)
+	return []*CurrencyRates{rates}, nil
+}
+
+// what is "latest" or YYYY-MM-DD for historical rates
+func (p *fixerProvider) fetch(what string) (*CurrencyRates, error) {
+	if fixerAPIKey == "" {
+		return nil, errors.New("FIXER_API_KEY is not set")
+	}
+	// free plan only supports http
+	uri := "http://data.fixer.io/api/" + what + "?access_key=" + url.QueryEscape(fixerAPIKey)
+	d, err := getCurrencyProviderData(p.up, uri)
+	if err != nil {
+		return nil, err
+	}
+	var rsp struct {
+		Success   bool               `json:"success"`
+		Timestamp int64              `json:"timestamp"`
+		Base      string             `json:"base"`
+		Rates     map[string]float64 `json:"rates"`
+		Error     *struct {
+			Code int    `json:"code"`
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	err = json.Unmarshal(d, &rsp)
+	if err != nil {
+		return nil, err
+	}
+	if !rsp.Success {
+		if rsp.Error != nil {
+			return nil, e("error %d: '%s'", rsp.Error.Code, rsp.Error.Type)
+		}
+		return nil, errors.New("request failed")
+	}
+	return &CurrencyRates{
+		Base:               rsp.Base,
+		Rates:              rsp.Rates,
+		TimeLastUpdateUnix: rsp.Timestamp,
+	}, nil
+}
+
+// getCurrencyProviderData returns body of a successful GET request
+func getCurrencyProviderData(up *upstream, uri string) ([]byte, error) {
+	rsp, err := up.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, e("got status code %d", rsp.StatusCode)
+	}
+	// full history of ECB rates is ~7 MB
+	return io.ReadAll(io.LimitReader(rsp.Body, 32*1024*1024))
+}
+
+var (
+	// FIXER_API_KEY secret for fixerProvider
+	fixerAPIKey string
+
+	// all providers, each with its own circuit breaker so that
+	// one failing provider doesn't affect the others
+	currencyProviders = []currencyProvider{
+		&openERAPIProvider{up: newUpstream("open.er-api.com", 15*time.Second)},
+		&ecbProvider{up: newUpstream("ecb.europa.eu", 15*time.Second)},
+		&fixerProvider{up: newUpstream("fixer.io", 15*time.Second)},
+	}
+	// order in which providers are tried if config.CurrencyProviders is empty
+	currencyProvidersDefault = []string{"open.er-api", "ecb", "fixer"}
+)
+
+func findCurrencyProvider(name string) currencyProvider {
+	for _, p := range currencyProviders {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// getCurrencyProviders returns providers in the order they should be tried
+func getCurrencyProviders() []currencyProvider {
+	names := config.CurrencyProviders
+	if len(names) == 0 {
+		names = currencyProvidersDefault
+	}
+	var res []currencyProvider
+	for _, name := range names {
+		if p := findCurrencyProvider(name); p != nil {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+func validateCurrencyProviders() {
+	for _, name := range config.CurrencyProviders {
+		panicIf(findCurrencyProvider(name) == nil, "unknown currency provider '%s' in CurrencyProviders", name)
+	}
+	var names []string
+	for _, p := range getCurrencyProviders() {
+		names = append(names, p.Name())
+	}
+	logf("validateCurrencyProviders: currency rates from: %s\n", strings.Join(names, ", "))
+}
+
+// fetchCurrencyRates tries providers in order and returns rates
+// from the first one that works
+func fetchCurrencyRates() (*CurrencyRates, error) {
+	var errs []error
+	for _, p := range getCurrencyProviders() {
+		rates, err := p.Fetch()
+		if err == nil && len(rates.Rates) == 0 {
+			err = errors.New("no rates in the response")
+		}
+		if err != nil {
+			logf("fetchCurrencyRates: provider '%s' failed with '%s'\n", p.Name(), err)
+			errs = append(errs, e("%s: %w", p.Name(), err))
+			continue
+		}
+		rates.Provider = p.Name()
+		rates.TimeFetchedUnix = time.Now().Unix()
+		return rates, nil
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no currency providers")
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const ecbDailyXML = `<?xml version="1.0" encoding="UTF-8"?>
+<gesmes:Envelope xmlns:gesmes="http://www.gesmes.org/xml/2002-08-01" xmlns="http://www.ecb.int/vocabulary/2002-08-01/eurofxref">
+	<gesmes:subject>Reference rates</gesmes:subject>
+	<gesmes:Sender>
+		<gesmes:name>European Central Bank</gesmes:name>
+	</gesmes:Sender>
+	<Cube>
+		<Cube time="2024-05-10">
+			<Cube currency="USD" rate="1.0772"/>
+			<Cube currency="JPY" rate="167.74"/>
+		</Cube>
+		<Cube time="2024-05-09">
+			<Cube currency="USD" rate="1.0745"/>
+		</Cube>
+	</Cube>
+</gesmes:Envelope>`
+
+func TestParseECBRates(t *testing.T) {
+	days, err := parseECBRates([]byte(ecbDailyXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(days) != 2 {
+		t.Fatalf("got %d days, want 2", len(days))
+	}
+	latest := days[0]
+	if latest.Base != "EUR" || latest.Date != "2024-05-10" {
+		t.Errorf("got base %q date %q", latest.Base, latest.Date)
+	}
+	want := map[string]float64{"EUR": 1, "USD": 1.0772, "JPY": 167.74}
+	if len(latest.Rates) != len(want) {
+		t.Errorf("got rates %v, want %v", latest.Rates, want)
+	}
+	for k, v := range want {
+		if latest.Rates[k] != v {
+			t.Errorf("%s: got %v, want %v", k, latest.Rates[k], v)
+		}
+	}
+	// published at 16:00 CET
+	wantTime := time.Date(2024, 5, 10, 15, 0, 0, 0, time.UTC).Unix()
+	if latest.TimeLastUpdateUnix != wantTime {
+		t.Errorf("got time %d, want %d", latest.TimeLastUpdateUnix, wantTime)
+	}
+	if days[1].Date != "2024-05-09" || days[1].Rates["USD"] != 1.0745 {
+		t.Errorf("got %+v", days[1])
+	}
+}
+
+func TestParseECBRatesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		xml     string
+		wantErr string
+	}{
+		{"not xml", "not xml", "EOF"},
+		{"no days", `<Envelope><Cube></Cube></Envelope>`, "no rates"},
+		{"invalid date", `<Envelope><Cube><Cube time="10.05.2024"></Cube></Cube></Envelope>`, "cannot parse"},
+		{"invalid rate", `<Envelope><Cube><Cube time="2024-05-10"><Cube currency="USD" rate="x"/></Cube></Cube></Envelope>`, "invalid rate 'x' of 'USD'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseECBRates([]byte(tt.xml))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// latest currency rates are kept in memory and in data dir so that they
+// survive restarts. They're refreshed in the background every
+// currencyUpdateFreq. Requests never wait for a refresh unless we don't
+// have any rates yet. When rates are stale we serve them anyway and
+// refresh in the background. Concurrent refreshes are merged into one
+
+var (
+	currencyUpdateFreq = time.Hour * 24
+	// after a failed refresh, don't try again sooner than this
+	currencyRetryFreq = time.Minute * 5
+
+	muCurrency sync.Mutex
+	// marshaled CurrencyRates
+	cachedCurrencyRatesJSON []byte
+	currencyRatesLastUpdate time.Time
+	currencyRatesLastTry    time.Time
+	// not nil while refresh is in progress, closed when it's done
+	currencyRefreshDone chan struct{}
+	currencyRefreshErr  error
+)
+
+func getCurrencyRatesPath() string {
+	return filepath.Join(getDataDirMust(), "currency_rates.json")
+}
+
+// loadCurrencyRates loads rates saved by the last refresh
+func loadCurrencyRates() {
+	path := getCurrencyRatesPath()
+	d, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logf("loadCurrencyRates: os.ReadFile('%s') failed with '%s'\n", path, err)
+		}
+		return
+	}
+	var rates CurrencyRates
+	err = json.Unmarshal(d, &rates)
+	if err != nil || len(rates.Rates) == 0 {
+		logf("loadCurrencyRates: '%s' is not valid, error: '%v'\n", path, err)
+		return
+	}
+	muCurrency.Lock()
+	defer muCurrency.Unlock()
+	cachedCurrencyRatesJSON = d
+	currencyRatesLastUpdate = time.Unix(rates.TimeFetchedUnix, 0)
+	logf("loadCurrencyRates: loaded rates from '%s', provider: %s, updated: %s\n", path, rates.Provider, currencyRatesLastUpdate)
+}
+
+// saveCurrencyRates writes to a temp file and renames so that we never
+// leave a partially written file
+func saveCurrencyRates(d []byte) error {
+	path := getCurrencyRatesPath()
+	tmpPath := path + ".tmp"
+	err := os.WriteFile(tmpPath, d, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// refreshCurrencyRates gets rates from providers. If refresh is already
+// in progress, waits for it to finish and returns its result
+func refreshCurrencyRates() error {
+	muCurrency.Lock()
+	if done := currencyRefreshDone; done != nil {
+		muCurrency.Unlock()
+		<-done
+		muCurrency.Lock()
+		defer muCurrency.Unlock()
+		return currencyRefreshErr
+	}
+	done := make(chan struct{})
+	currencyRefreshDone = done
+	currencyRatesLastTry = time.Now()
+	muCurrency.Unlock()
+
+	d, err := getCurrencyRates()
+	if err == nil {
+		logf("refreshCurrencyRates: got data of size %d %s\n", len(d), truncData(d, 64))
+		if err := saveCurrencyRates(d); err != nil {
+			logf("refreshCurrencyRates: saveCurrencyRates() failed with '%s'\n", err)
+		}
+		var rates CurrencyRates
+		must(json.Unmarshal(d, &rates))
+		if err := saveCurrencySnapshot(&rates, true); err != nil {
+			logf("refreshCurrencyRates: saveCurrencySnapshot() failed with '%s'\n", err)
+		}
+	} else {
+		logf("refreshCurrencyRates: getCurrencyRates() failed with: '%s'\n", err)
+	}
+
+	muCurrency.Lock()
+	defer muCurrency.Unlock()
+	if err == nil {
+		cachedCurrencyRatesJSON = d
+		currencyRatesLastUpdate = time.Now()
+	}
+	currencyRefreshErr = err
+	currencyRefreshDone = nil
+	close(done)
+	return err
+}
+
+// needsCurrencyRefresh must be called with muCurrency locked
+func needsCurrencyRefresh() bool {
+	if currencyRefreshDone != nil {
+		return false
+	}
+	if time.Since(currencyRatesLastUpdate) < currencyUpdateFreq {
+		return false
+	}
+	return time.Since(currencyRatesLastTry) >= currencyRetryFreq
+}
+
+// getCachedCurrencyRates returns the latest rates, starting a background
+// refresh if they're stale. Only waits for the refresh if we have no rates
+func getCachedCurrencyRates() ([]byte, error) {
+	muCurrency.Lock()
+	d := cachedCurrencyRatesJSON
+	refresh := needsCurrencyRefresh()
+	muCurrency.Unlock()
+	if d != nil {
+		if refresh {
+			go refreshCurrencyRates()
+		}
+		return d, nil
+	}
+	err := refreshCurrencyRates()
+	if err != nil {
+		return nil, err
+	}
+	muCurrency.Lock()
+	defer muCurrency.Unlock()
+	return cachedCurrencyRatesJSON, nil
+}
+
+// startCurrencyRatesRefresher loads saved rates and keeps them fresh
+func startCurrencyRatesRefresher() {
+	loadCurrencyRates()
+	startCryptoRatesRefresher()
+	go func() {
+		for {
+			muCurrency.Lock()
+			refresh := needsCurrencyRefresh()
+			sinceUpdate := time.Since(currencyRatesLastUpdate)
+			muCurrency.Unlock()
+			if refresh {
+				_ = refreshCurrencyRates()
+				continue
+			}
+			// wake up when rates become stale or to retry after a failure
+			sleep := max(currencyUpdateFreq-sinceUpdate, currencyRetryFreq)
+			time.Sleep(sleep)
+		}
+	}()
+}
+
+// POST /api/currency_rates/refresh
+// gets the latest rates from providers, even if the cached ones are fresh
+func refreshCurrencyRatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdminRequest(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	err := refreshCurrencyRates()
+	if err != nil {
+		serveUpstreamError(w, err, "Failed to get currency rates")
+		return
+	}
+	muCurrency.Lock()
+	d := cachedCurrencyRatesJSON
+	muCurrency.Unlock()
+	serveJSON(w, getMergedCurrencyRates(d).d)
+}
+
+// mergedCurrencyRates is the document served as /api/currency_rates.json
+type mergedCurrencyRates struct {
+	// inputs it was built from
+	fiat         []byte
+	crypto       *CurrencyRates
+	unitsModTime time.Time
+
+	d    []byte
+	etag string
+	// content can change when crypto rates or custom units change
+	modTime time.Time
+}
+
+var (
+	muMergedCurrency sync.Mutex
+	// nil until the first request
+	cachedMergedCurrency *mergedCurrencyRates
+)
+
+// getMergedCurrencyRates returns fiat rates merged with crypto and custom units.
+// It's only re-built when fiat rates, crypto rates or custom units change
+func getMergedCurrencyRates(fiat []byte) *mergedCurrencyRates {
+	muCrypto.Lock()
+	crypto := cachedCryptoRates
+	muCrypto.Unlock()
+	units, unitsModTime := getCustomUnits()
+
+	muMergedCurrency.Lock()
+	defer muMergedCurrency.Unlock()
+	m := cachedMergedCurrency
+	if m != nil && m.crypto == crypto && m.unitsModTime.Equal(unitsModTime) && bytes.Equal(m.fiat, fiat) {
+		return m
+	}
+	m = &mergedCurrencyRates{
+		fiat:         fiat,
+		crypto:       crypto,
+		unitsModTime: unitsModTime,
+	}
+	d, err := mergeCurrencyRates(fiat, crypto, units)
+	if err != nil {
+		logf("getMergedCurrencyRates: mergeCurrencyRates() failed with '%s'\n", err)
+		d = fiat
+	}
+	m.d = d
+	h := sha256.Sum256(d)
+	m.etag = `"` + hex.EncodeToString(h[:16]) + `"`
+	var rates MergedCurrencyRates
+	err = json.Unmarshal(d, &rates)
+	if err != nil {
+		logf("getMergedCurrencyRates: json.Unmarshal() failed with '%s'\n", err)
+	}
+	m.modTime = time.Unix(max(rates.TimeFetchedUnix, rates.CryptoTimeFetchedUnix), 0)
+	if unitsModTime.After(m.modTime) {
+		m.modTime = unitsModTime
+	}
+	cachedMergedCurrency = m
+	return m
+}
+
+// currencyRatesMaxAge returns time until the next refresh of rates
+func currencyRatesMaxAge() time.Duration {
+	muCurrency.Lock()
+	next := currencyRatesLastUpdate.Add(currencyUpdateFreq)
+	muCurrency.Unlock()
+	muCrypto.Lock()
+	if cachedCryptoRates != nil {
+		cryptoNext := time.Unix(cachedCryptoRates.TimeFetchedUnix, 0).Add(cryptoUpdateFreq)
+		if cryptoNext.Before(next) {
+			next = cryptoNext
+		}
+	}
+	muCrypto.Unlock()
+	return max(time.Until(next), 0)
+}
+
+// serveCurrencyRates serves rates with validators so that browsers and
+// Cloudflare can revalidate with If-None-Match / If-Modified-Since and
+// get 304 instead of downloading the same rates again
+func serveCurrencyRates(w http.ResponseWriter, r *http.Request, fiat []byte) {
+	m := getMergedCurrencyRates(fiat)
+	maxAge := int(currencyRatesMaxAge().Seconds())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", m.etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+	http.ServeContent(w, r, "currency_rates.json", m.modTime, bytes.NewReader(m.d))
+}
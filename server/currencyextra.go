@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// besides fiat currencies /api/currency_rates.json can have:
+// - crypto assets (BTC, ETH etc.) from config.CryptoProvider. Prices of
+//   crypto change quickly so they're refreshed more often than fiat rates
+// - custom units defined by the operator in currency_units.json in data dir,
+//   e.g. internal billing credits or company-mandated budget rates
+
+// MergedCurrencyRates is CurrencyRates with crypto and custom units added
+// to Rates and info about when crypto prices were updated
+type MergedCurrencyRates struct {
+	CurrencyRates
+	CryptoProvider           string `json:"crypto_provider,omitempty"`
+	CryptoTimeLastUpdateUnix int64  `json:"crypto_time_last_update_unix,omitempty"`
+	CryptoTimeFetchedUnix    int64  `json:"crypto_time_fetched_unix,omitempty"`
+	// names of units from currency_units.json
+	CustomUnits []string `json:"custom_units,omitempty"`
+}
+
+// https://docs.coingecko.com/reference/simple-price, public api is rate
+// limited to ~30 requests per minute
+type coinGeckoProvider struct {
+	up *upstream
+}
+
+func (p *coinGeckoProvider) Name() string {
+	return "coingecko"
+}
+
+// maps symbol (used as unit name) to coingecko id
+var cryptoAssetsDefault = map[string]string{
+	"BTC":  "bitcoin",
+	"ETH":  "ethereum",
+	"SOL":  "solana",
+	"XRP":  "ripple",
+	"ADA":  "cardano",
+	"DOGE": "dogecoin",
+	"LTC":  "litecoin",
+	"DOT":  "polkadot",
+	"USDT": "tether",
+	"USDC": "usd-coin",
+}
+
+func getCryptoAssets() map[string]string {
+	if len(config.CryptoAssets) > 0 {
+		return config.CryptoAssets
+	}
+	return cryptoAssetsDefault
+}
+
+func (p *coinGeckoProvider) Fetch() (*CurrencyRates, error) {
+	assets := getCryptoAssets()
+	var ids []string
+	for _, id := range assets {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	uri := "https://api.coingecko.com/api/v3/simple/price?vs_currencies=eur&include_last_updated_at=true&ids=" + url.QueryEscape(strings.Join(ids, ","))
+	d, err := getCurrencyProviderData(p.up, uri)
+	if err != nil {
+		return nil, err
+	}
+	// {"bitcoin":{"eur":57000.12,"last_updated_at":1715350000}}
+	var rsp map[string]struct {
+		EUR           float64 `json:"eur"`
+		LastUpdatedAt int64   `json:"last_updated_at"`
+	}
+	err = json.Unmarshal(d, &rsp)
+	if err != nil {
+		return nil, err
+	}
+	res := &CurrencyRates{
+		Base:  "EUR",
+		Rates: map[string]float64{},
+	}
+	for symbol, id := range assets {
+		price, ok := rsp[id]
+		if !ok || price.EUR <= 0 {
+			continue
+		}
+		// rates are how many units we get for 1 EUR
+		res.Rates[symbol] = 1 / price.EUR
+		res.TimeLastUpdateUnix = max(res.TimeLastUpdateUnix, price.LastUpdatedAt)
+	}
+	return res, nil
+}
+
+var (
+	cryptoProviders = []currencyProvider{
+		&coinGeckoProvider{up: newUpstream("coingecko.com", 15*time.Second)},
+	}
+	cryptoUpdateFreq = time.Minute * 10
+
+	muCrypto sync.Mutex
+	// nil until the first successful refresh
+	cachedCryptoRates *CurrencyRates
+)
+
+func getCryptoProvider() currencyProvider {
+	for _, p := range cryptoProviders {
+		if p.Name() == config.CryptoProvider {
+			return p
+		}
+	}
+	return nil
+}
+
+func validateCryptoProvider() {
+	name := config.CryptoProvider
+	if name == "" {
+		return
+	}
+	panicIf(getCryptoProvider() == nil, "unknown crypto provider '%s' in CryptoProvider", name)
+	logf("validateCryptoProvider: crypto rates from: %s\n", name)
+}
+
+func refreshCryptoRates(p currencyProvider) {
+	rates, err := p.Fetch()
+	if err == nil && len(rates.Rates) == 0 {
+		err = errors.New("no rates in the response")
+	}
+	if err != nil {
+		logf("refreshCryptoRates: provider '%s' failed with '%s'\n", p.Name(), err)
+		return
+	}
+	rates.Provider = p.Name()
+	rates.TimeFetchedUnix = time.Now().Unix()
+	muCrypto.Lock()
+	cachedCryptoRates = rates
+	muCrypto.Unlock()
+}
+
+// startCryptoRatesRefresher refreshes crypto rates every cryptoUpdateFreq
+func startCryptoRatesRefresher() {
+	p := getCryptoProvider()
+	if p == nil {
+		return
+	}
+	go func() {
+		for {
+			refreshCryptoRates(p)
+			time.Sleep(cryptoUpdateFreq)
+		}
+	}()
+}
+
+// CustomUnit is a unit defined in currency_units.json, which maps unit
+// name to its definition e.g.:
+//
+//	{
+//	  "CREDIT": {"Value": 0.1, "Currency": "USD"},
+//	  "BUDGET_USD": {"Formula": "USD * 1.05"}
+//	}
+//
+// means that 1 CREDIT is 0.1 USD and 1 BUDGET_USD is 5% more than 1 USD
+type CustomUnit struct {
+	// fixed value of 1 unit in Currency
+	Value float64 `json:",omitempty"`
+	// or a formula that calculates value of 1 unit in Currency. Can use
+	// numbers, + - * / and names of currencies which mean value of
+	// 1 unit of that currency in Currency
+	Formula string `json:",omitempty"`
+	// default is the base currency of the rates (EUR)
+	Currency string `json:",omitempty"`
+
+	formula ast.Expr
+}
+
+var (
+	rxCustomUnitName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+	muCustomUnits sync.Mutex
+	customUnits   map[string]*CustomUnit
+	// mod time of currency_units.json when we loaded it so that
+	// changes are picked up without restarting the server
+	customUnitsModTime time.Time
+	// we don't check if the file changed more often than customUnitsCheckFreq
+	customUnitsLastCheck time.Time
+	customUnitsCheckFreq = time.Second * 30
+)
+
+func getCustomUnitsPath() string {
+	return filepath.Join(getDataDirMust(), "currency_units.json")
+}
+
+// parseCustomUnits returns valid units, logs and skips invalid ones
+func parseCustomUnits(d []byte) (map[string]*CustomUnit, error) {
+	var units map[string]*CustomUnit
+	err := json.Unmarshal(d, &units)
+	if err != nil {
+		return nil, err
+	}
+	for name, cu := range units {
+		err = nil
+		switch {
+		case !rxCustomUnitName.MatchString(name):
+			err = errors.New("invalid name")
+		case cu == nil || (cu.Value == 0) == (cu.Formula == ""):
+			err = errors.New("must have either Value or Formula")
+		case cu.Value < 0:
+			err = errors.New("value must be positive")
+		case cu.Formula != "":
+			cu.formula, err = parser.ParseExpr(cu.Formula)
+		}
+		if err != nil {
+			logf("parseCustomUnits: skipping '%s': %s\n", name, err)
+			delete(units, name)
+		}
+	}
+	return units, nil
+}
+
+// getCustomUnits returns units from currency_units.json and its mod time,
+// reloading it if it changed
+func getCustomUnits() (map[string]*CustomUnit, time.Time) {
+	muCustomUnits.Lock()
+	defer muCustomUnits.Unlock()
+	if time.Since(customUnitsLastCheck) < customUnitsCheckFreq {
+		return customUnits, customUnitsModTime
+	}
+	customUnitsLastCheck = time.Now()
+	path := getCustomUnitsPath()
+	fi, err := os.Stat(path)
+	if err != nil {
+		customUnits = nil
+		customUnitsModTime = time.Time{}
+		return nil, customUnitsModTime
+	}
+	if fi.ModTime().Equal(customUnitsModTime) {
+		return customUnits, customUnitsModTime
+	}
+	customUnitsModTime = fi.ModTime()
+	customUnits = nil
+	d, err := os.ReadFile(path)
+	if err == nil {
+		customUnits, err = parseCustomUnits(d)
+	}
+	if err != nil {
+		logf("getCustomUnits: failed to load '%s': %s\n", path, err)
+		return nil, customUnitsModTime
+	}
+	logf("getCustomUnits: loaded %d units from '%s'\n", len(customUnits), path)
+	return customUnits, customUnitsModTime
+}
+
+// evalUnitFormula evaluates expr. value(name) returns value of currency name
+func evalUnitFormula(expr ast.Expr, value func(name string) (float64, bool)) (float64, error) {
+	switch x := expr.(type) {
+	case *ast.ParenExpr:
+		return evalUnitFormula(x.X, value)
+	case *ast.BasicLit:
+		if x.Kind != token.INT && x.Kind != token.FLOAT {
+			return 0, e("unsupported literal '%s'", x.Value)
+		}
+		return strconv.ParseFloat(x.Value, 64)
+	case *ast.Ident:
+		v, ok := value(x.Name)
+		if !ok {
+			return 0, e("unknown currency '%s'", x.Name)
+		}
+		return v, nil
+	case *ast.UnaryExpr:
+		v, err := evalUnitFormula(x.X, value)
+		if err != nil {
+			return 0, err
+		}
+		switch x.Op {
+		case token.ADD:
+			return v, nil
+		case token.SUB:
+			return -v, nil
+		}
+	case *ast.BinaryExpr:
+		a, err := evalUnitFormula(x.X, value)
+		if err != nil {
+			return 0, err
+		}
+		b, err := evalUnitFormula(x.Y, value)
+		if err != nil {
+			return 0, err
+		}
+		switch x.Op {
+		case token.ADD:
+			return a + b, nil
+		case token.SUB:
+			return a - b, nil
+		case token.MUL:
+			return a * b, nil
+		case token.QUO:
+			if b == 0 {
+				return 0, errors.New("division by zero")
+			}
+			return a / b, nil
+		}
+	}
+	return 0, errors.New("unsupported expression, only numbers, currencies and + - * / are allowed")
+}
+
+// customUnitRate returns how many units we get for 1 unit of base
+// currency, given rates of other currencies
+func customUnitRate(cu *CustomUnit, rates map[string]float64) (float64, error) {
+	currencyRate := 1.0
+	if cu.Currency != "" {
+		r, ok := rates[cu.Currency]
+		if !ok {
+			return 0, e("unknown currency '%s'", cu.Currency)
+		}
+		currencyRate = r
+	}
+	v := cu.Value
+	if cu.formula != nil {
+		// value of 1 unit of currency name in cu.Currency
+		value := func(name string) (float64, bool) {
+			r, ok := rates[name]
+			if !ok || r == 0 {
+				return 0, false
+			}
+			return currencyRate / r, true
+		}
+		var err error
+		v, err = evalUnitFormula(cu.formula, value)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if v <= 0 {
+		return 0, e("value must be positive, is %v", v)
+	}
+	return currencyRate / v, nil
+}
+
+// mergeCurrencyRates adds crypto and custom units to fiat rates.
+// crypto can be nil
+func mergeCurrencyRates(fiat []byte, crypto *CurrencyRates, units map[string]*CustomUnit) ([]byte, error) {
+	if crypto == nil && len(units) == 0 {
+		return fiat, nil
+	}
+
+	var res MergedCurrencyRates
+	err := json.Unmarshal(fiat, &res.CurrencyRates)
+	if err != nil {
+		return nil, err
+	}
+	fiatRates := res.Rates
+	res.Rates = map[string]float64{}
+	for k, v := range fiatRates {
+		res.Rates[k] = v
+	}
+	// base of crypto rates can be different than base of fiat rates
+	if crypto != nil {
+		mult := 1.0
+		if crypto.Base != res.Base {
+			mult = res.Rates[crypto.Base]
+		}
+		if mult > 0 {
+			for k, v := range crypto.Rates {
+				// fiat currency wins if the names clash
+				if _, ok := res.Rates[k]; !ok {
+					res.Rates[k] = v * mult
+				}
+			}
+			res.CryptoProvider = crypto.Provider
+			res.CryptoTimeLastUpdateUnix = crypto.TimeLastUpdateUnix
+			res.CryptoTimeFetchedUnix = crypto.TimeFetchedUnix
+		}
+	}
+	// custom units can't be defined in terms of other custom units
+	// so we add them after calculating all of them
+	customRates := map[string]float64{}
+	for name, cu := range units {
+		if _, ok := res.Rates[name]; ok {
+			logf("mergeCurrencyRates: custom unit '%s' clashes with a currency\n", name)
+			continue
+		}
+		rate, err := customUnitRate(cu, res.Rates)
+		if err != nil {
+			logf("mergeCurrencyRates: custom unit '%s': %s\n", name, err)
+			continue
+		}
+		customRates[name] = rate
+		res.CustomUnits = append(res.CustomUnits, name)
+	}
+	for name, rate := range customRates {
+		res.Rates[name] = rate
+	}
+	slices.Sort(res.CustomUnits)
+	return json.Marshal(&res)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"go/parser"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestEvalUnitFormula(t *testing.T) {
+	values := map[string]float64{"USD": 0.5, "GBP": 1.25}
+	value := func(name string) (float64, bool) {
+		v, ok := values[name]
+		return v, ok
+	}
+	tests := []struct {
+		formula string
+		want    float64
+		wantErr string
+	}{
+		{formula: "2", want: 2},
+		{formula: "1.5", want: 1.5},
+		{formula: "USD", want: 0.5},
+		{formula: "USD * 1.05", want: 0.525},
+		{formula: "(USD + GBP) / 2", want: 0.875},
+		{formula: "-USD + 1", want: 0.5},
+		{formula: "+GBP", want: 1.25},
+		{formula: "GBP - USD", want: 0.75},
+		{formula: "FOO * 2", wantErr: "unknown currency 'FOO'"},
+		{formula: "USD / 0", wantErr: "division by zero"},
+		{formula: `"USD"`, wantErr: "unsupported literal"},
+		{formula: "USD % 2", wantErr: "unsupported expression"},
+		{formula: "f(USD)", wantErr: "unsupported expression"},
+		{formula: "!USD", wantErr: "unsupported expression"},
+	}
+	for _, tt := range tests {
+		expr, err := parser.ParseExpr(tt.formula)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.formula, err)
+		}
+		got, err := evalUnitFormula(expr, value)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, want %q", tt.formula, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.formula, err)
+			continue
+		}
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: got %v, want %v", tt.formula, got, tt.want)
+		}
+	}
+}
+
+func TestCustomUnitRate(t *testing.T) {
+	// 1 EUR is 2 USD and 0.8 GBP
+	rates := map[string]float64{"EUR": 1, "USD": 2, "GBP": 0.8}
+	tests := []struct {
+		name    string
+		unit    string
+		want    float64
+		wantErr string
+	}{
+		{name: "value in base currency", unit: `{"Value": 0.5}`, want: 2},
+		{name: "value in other currency", unit: `{"Value": 0.1, "Currency": "USD"}`, want: 20},
+		{name: "formula", unit: `{"Formula": "USD * 1.05"}`, want: 2 / 1.05},
+		{name: "formula in other currency", unit: `{"Formula": "GBP / 2", "Currency": "USD"}`, want: 0.8 * 2},
+		{name: "unknown currency", unit: `{"Value": 1, "Currency": "XXX"}`, wantErr: "unknown currency 'XXX'"},
+		{name: "negative result", unit: `{"Formula": "0 - USD"}`, wantErr: "value must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			units, err := parseCustomUnits([]byte(`{"U": ` + tt.unit + `}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cu := units["U"]
+			if cu == nil {
+				t.Fatalf("unit %s was rejected", tt.unit)
+			}
+			got, err := customUnitRate(cu, rates)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCustomUnits(t *testing.T) {
+	d := `{
+		"CREDIT": {"Value": 0.1, "Currency": "USD"},
+		"BUDGET_USD": {"Formula": "USD * 1.05"},
+		"bad name": {"Value": 1},
+		"BOTH": {"Value": 1, "Formula": "USD"},
+		"NEITHER": {},
+		"NEGATIVE": {"Value": -1},
+		"SYNTAX": {"Formula": "USD *"}
+	}`
+	units, err := parseCustomUnits([]byte(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(units) != 2 || units["CREDIT"] == nil || units["BUDGET_USD"] == nil {
+		t.Errorf("got units %v, want CREDIT and BUDGET_USD", units)
+	}
+	if _, err = parseCustomUnits([]byte("[1]")); err == nil {
+		t.Errorf("expected error for invalid json")
+	}
+}
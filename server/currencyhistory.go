@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// every time we refresh currency rates we save them as a snapshot for that
+// day in data dir. /api/currency_rates/${YYYY-MM-DD} returns the snapshot
+// for a given day. Days we don't have can be backfilled from a provider
+// that has historical rates (config.CurrencyHistoryProvider). A backfill
+// can return decades of rates so they're saved in one file per year
+// instead of a file per day
+
+// currencyHistoryProvider is a currency provider that has rates from the past
+type currencyHistoryProvider interface {
+	currencyProvider
+	// returns rates for date, might also return rates for other days
+	FetchHistory(date time.Time) ([]*CurrencyRates, error)
+}
+
+const (
+	// providers don't publish rates on weekends and holidays so rates
+	// for a day are the latest rates published up to this many days before
+	maxCurrencySnapshotAge = 7
+	// backfilling uses provider's quota so we don't do it too often
+	currencyBackfillFreq = time.Minute
+)
+
+var (
+	muCurrencyBackfill   sync.Mutex
+	currencyLastBackfill time.Time
+	// days we tried to backfill and when, so that we don't ask for
+	// days the provider doesn't have over and over
+	currencyBackfillTried = map[string]time.Time{}
+
+	muCurrencyHistory sync.Mutex
+	// backfilled rates loaded from files, year => day => marshaled CurrencyRates
+	backfilledCurrencyRates = map[int]map[string]json.RawMessage{}
+)
+
+func getCurrencyHistoryDir() string {
+	return filepath.Join(getDataDirMust(), "currency_history")
+}
+
+func currencySnapshotPath(day string) string {
+	return filepath.Join(getCurrencyHistoryDir(), day+".json")
+}
+
+func backfilledCurrencyRatesPath(year int) string {
+	return filepath.Join(getCurrencyHistoryDir(), f("backfill-%d.json", year))
+}
+
+// writeFileAtomically writes to a temp file and renames so that we never
+// leave a partially written file
+func writeFileAtomically(path string, d []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, d, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// currencyRatesDay returns the day the rates are for
+func currencyRatesDay(rates *CurrencyRates) string {
+	if rates.Date != "" {
+		return rates.Date
+	}
+	t := rates.TimeLastUpdateUnix
+	if t == 0 {
+		t = rates.TimeFetchedUnix
+	}
+	return time.Unix(t, 0).UTC().Format(time.DateOnly)
+}
+
+// saveCurrencySnapshot saves rates as a snapshot of the day they're for.
+// If overwrite is false, existing snapshot is kept
+func saveCurrencySnapshot(rates *CurrencyRates, overwrite bool) error {
+	day := currencyRatesDay(rates)
+	path := currencySnapshotPath(day)
+	if !overwrite {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+	}
+	snapshot := *rates
+	snapshot.Date = day
+	d, err := json.Marshal(&snapshot)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path, d)
+}
+
+// getBackfilledYear returns backfilled rates for a year, loading them
+// from the file if needed. Must be called with muCurrencyHistory locked
+func getBackfilledYear(year int) map[string]json.RawMessage {
+	if m, ok := backfilledCurrencyRates[year]; ok {
+		return m
+	}
+	m := map[string]json.RawMessage{}
+	path := backfilledCurrencyRatesPath(year)
+	d, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(d, &m)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logf("getBackfilledYear: failed to load '%s': %s\n", path, err)
+		m = map[string]json.RawMessage{}
+	}
+	backfilledCurrencyRates[year] = m
+	return m
+}
+
+// saveBackfilledCurrencyRates adds rates to backfilled rates and
+// re-writes files of the years that changed
+func saveBackfilledCurrencyRates(days []*CurrencyRates) error {
+	muCurrencyHistory.Lock()
+	defer muCurrencyHistory.Unlock()
+	changed := map[int]bool{}
+	for _, rates := range days {
+		day := currencyRatesDay(rates)
+		date, err := time.Parse(time.DateOnly, day)
+		if err != nil {
+			return err
+		}
+		snapshot := *rates
+		snapshot.Date = day
+		d, err := json.Marshal(&snapshot)
+		if err != nil {
+			return err
+		}
+		getBackfilledYear(date.Year())[day] = d
+		changed[date.Year()] = true
+	}
+	for year := range changed {
+		d, err := json.Marshal(backfilledCurrencyRates[year])
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomically(backfilledCurrencyRatesPath(year), d)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findCurrencySnapshot returns the latest snapshot at or before date.
+// Snapshots from refreshes are more accurate than backfilled rates
+func findCurrencySnapshot(date time.Time) []byte {
+	for i := 0; i < maxCurrencySnapshotAge; i++ {
+		t := date.AddDate(0, 0, -i)
+		day := t.Format(time.DateOnly)
+		d, err := os.ReadFile(currencySnapshotPath(day))
+		if err == nil {
+			return d
+		}
+		muCurrencyHistory.Lock()
+		d = getBackfilledYear(t.Year())[day]
+		muCurrencyHistory.Unlock()
+		if d != nil {
+			return d
+		}
+	}
+	return nil
+}
+
+func getCurrencyHistoryProvider() currencyHistoryProvider {
+	if config.CurrencyHistoryProvider == "" {
+		return nil
+	}
+	p, _ := findCurrencyProvider(config.CurrencyHistoryProvider).(currencyHistoryProvider)
+	return p
+}
+
+func validateCurrencyHistoryProvider() {
+	name := config.CurrencyHistoryProvider
+	if name == "" {
+		return
+	}
+	panicIf(getCurrencyHistoryProvider() == nil, "currency provider '%s' in CurrencyHistoryProvider doesn't have historical rates", name)
+	logf("validateCurrencyHistoryProvider: backfilling currency rates from: %s\n", name)
+}
+
+// backfillCurrencyRates gets rates for date from the history provider.
+// Returns how long to wait before trying again if we're asking too often
+func backfillCurrencyRates(p currencyHistoryProvider, date time.Time) (time.Duration, error) {
+	// backfill of a nearby day might have got this one too
+	if findCurrencySnapshot(date) != nil {
+		return 0, nil
+	}
+	day := date.Format(time.DateOnly)
+	muCurrencyBackfill.Lock()
+	if t, ok := currencyBackfillTried[day]; ok && time.Since(t) < time.Hour {
+		muCurrencyBackfill.Unlock()
+		return 0, nil
+	}
+	if wait := currencyBackfillFreq - time.Since(currencyLastBackfill); wait > 0 {
+		muCurrencyBackfill.Unlock()
+		return wait, nil
+	}
+	currencyLastBackfill = time.Now()
+	currencyBackfillTried[day] = time.Now()
+	muCurrencyBackfill.Unlock()
+
+	// rate limit above means only one fetch runs at a time
+	days, err := p.FetchHistory(date)
+	if err != nil {
+		return 0, err
+	}
+	fetched := time.Now().Unix()
+	for _, rates := range days {
+		rates.Provider = p.Name()
+		rates.TimeFetchedUnix = fetched
+	}
+	err = saveBackfilledCurrencyRates(days)
+	if err != nil {
+		return 0, err
+	}
+	logf("backfillCurrencyRates: got rates for %d days from '%s'\n", len(days), p.Name())
+	return 0, nil
+}
+
+// GET /api/currency_rates/${YYYY-MM-DD}
+// returns the rates that were valid on that day, in the same
+// format as /api/currency_rates.json
+func currencyRatesForDateHandler(w http.ResponseWriter, r *http.Request, day string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	date, err := time.Parse(time.DateOnly, day)
+	if err != nil {
+		http.Error(w, "Invalid date, must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	if date.After(time.Now().UTC()) {
+		http.Error(w, "Date is in the future", http.StatusBadRequest)
+		return
+	}
+	d := findCurrencySnapshot(date)
+	if d == nil {
+		if p := getCurrencyHistoryProvider(); p != nil {
+			wait, err := backfillCurrencyRates(p, date)
+			if wait > 0 {
+				serveTooManyRequests(w, wait, "Too many requests for historical currency rates, try again later")
+				return
+			}
+			if err != nil {
+				logf("currencyRatesForDateHandler: backfillCurrencyRates() failed with '%s'\n", err)
+				serveUpstreamError(w, err, "Failed to get currency rates")
+				return
+			}
+			d = findCurrencySnapshot(date)
+		}
+	}
+	if d == nil {
+		http.Error(w, "No currency rates for "+day, http.StatusNotFound)
+		return
+	}
+	serveJSON(w, d)
+}
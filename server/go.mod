@@ -12,7 +12,11 @@ require (
 	github.com/klauspost/compress v1.17.8
 	github.com/melbahja/goph v1.4.0
 	github.com/pkg/sftp v1.13.6
+	golang.org/x/mod v0.17.0
+	golang.org/x/net v0.25.0
 	golang.org/x/oauth2 v0.20.0
+	golang.org/x/sys v0.20.0
+	golang.org/x/tools v0.21.0
 )
 
 require (
@@ -26,9 +30,7 @@ require (
 	github.com/minio/minio-go/v7 v7.0.70 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/rs/xid v1.5.0 // indirect
-	golang.org/x/crypto v0.22.0 // indirect
-	golang.org/x/net v0.24.0 // indirect
-	golang.org/x/sys v0.20.0 // indirect
+	golang.org/x/crypto v0.23.0 // indirect
 	golang.org/x/text v0.15.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 )
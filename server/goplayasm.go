@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// architectures we can show assembly for. wasm is compiled with GOOS=js,
+// all others with GOOS=linux
+var asmArchs = []string{
+	"amd64",
+	"386",
+	"arm64",
+	"arm",
+	"riscv64",
+	"ppc64le",
+	"s390x",
+	"loong64",
+	"mips64le",
+	"wasm",
+}
+
+// don't send megabytes of assembly for large snippets
+const maxAsmInstructions = 50000
+
+// AsmInstruction is a single instruction generated for a line of source code
+type AsmInstruction struct {
+	// offset from the start of the function
+	PC   int
+	File string
+	Line int
+	// e.g. "MOVQ"
+	Op   string
+	Args string `json:",omitempty"`
+}
+
+// AsmFunction is assembly of a single function
+type AsmFunction struct {
+	// e.g. "main.main" or "play/util.F"
+	Name         string
+	Instructions []*AsmInstruction
+}
+
+// AsmAnnotation is an inlining or escape analysis decision of the compiler
+type AsmAnnotation struct {
+	File   string
+	Line   int
+	Column int
+	// "inline", "escape" or "other"
+	Kind    string
+	Message string
+}
+
+// AsmResponse is the response of /api/goplay/asm
+type AsmResponse struct {
+	GOARCH      string
+	GoVersion   string
+	Functions   []*AsmFunction
+	Annotations []*AsmAnnotation
+	// true if there was too much assembly and we only return some of it
+	Truncated bool       `json:",omitempty"`
+	ErrorInfo *PlayError `json:",omitempty"`
+}
+
+// "	0x0004 00004 (play/prog.go:10)	CMPQ	SP, 16(R14)"
+var rxAsmInstruction = regexp.MustCompile(`^\t0x[0-9a-f]+ (\d+) \((.+):(\d+)\)\t(\S+)\t?(.*)$`)
+
+// modulePath returns path of the module from go.mod e.g. "play"
+func (pd *programDir) modulePath() string {
+	d, err := os.ReadFile(filepath.Join(pd.Dir, "go.mod"))
+	if err != nil {
+		return ""
+	}
+	return modfile.ModulePath(d)
+}
+
+// asmFileName returns name of the file in the snippet given path in
+// -S or -m output e.g. "play/util/util.go" => "util/util.go"
+// returns "" for files not in the snippet e.g. from standard library
+func (pd *programDir) asmFileName(path string, modPath string) string {
+	if modPath != "" {
+		path = strings.TrimPrefix(path, modPath+"/")
+	}
+	name := pd.fileName(path)
+	if _, ok := pd.Files.data[name]; !ok {
+		return ""
+	}
+	return name
+}
+
+func asmAnnotationKind(msg string) string {
+	switch {
+	case strings.Contains(msg, "inline"):
+		return "inline"
+	case strings.Contains(msg, "escape"), strings.Contains(msg, "moved to heap"), strings.Contains(msg, "leaking param"):
+		return "escape"
+	}
+	return "other"
+}
+
+// parseAsmOutput parses output of the compiler with -S -m flags
+func parseAsmOutput(out string, pd *programDir, res *AsmResponse) {
+	modPath := pd.modulePath()
+	var curr *AsmFunction
+	nInstructions := 0
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, "\t") {
+			curr = nil
+			// "main.main STEXT size=155 args=0x0 locals=0x58"
+			// other symbols are data and not interesting
+			if fields := strings.Fields(line); len(fields) > 1 && fields[1] == "STEXT" {
+				curr = &AsmFunction{Name: fields[0]}
+				res.Functions = append(res.Functions, curr)
+				continue
+			}
+			// "play/prog.go:8:6: can inline add"
+			if m := rxCompilerError.FindStringSubmatch(line); m != nil {
+				name := pd.asmFileName(m[1], modPath)
+				if name == "" {
+					continue
+				}
+				a := &AsmAnnotation{
+					File:    name,
+					Kind:    asmAnnotationKind(m[4]),
+					Message: m[4],
+				}
+				a.Line, _ = strconv.Atoi(m[2])
+				a.Column, _ = strconv.Atoi(m[3])
+				res.Annotations = append(res.Annotations, a)
+			}
+			continue
+		}
+		if curr == nil {
+			continue
+		}
+		m := rxAsmInstruction.FindStringSubmatch(line)
+		if m == nil {
+			// hex dump of the code or relocations
+			continue
+		}
+		op := m[4]
+		// meta-data for garbage collector and stack maps
+		if op == "PCDATA" || op == "FUNCDATA" {
+			continue
+		}
+		if nInstructions >= maxAsmInstructions {
+			res.Truncated = true
+			continue
+		}
+		nInstructions++
+		inst := &AsmInstruction{
+			File: pd.asmFileName(m[2], modPath),
+			Op:   op,
+			Args: m[5],
+		}
+		inst.PC, _ = strconv.Atoi(m[1])
+		inst.Line, _ = strconv.Atoi(m[3])
+		curr.Instructions = append(curr.Instructions, inst)
+	}
+}
+
+// compileAsm compiles the code for goarch and returns generated assembly
+// and decisions about inlining and escape analysis
+func compileAsm(ctx context.Context, body string, goVersion string, goarch string) (*AsmResponse, error) {
+	res := &AsmResponse{GOARCH: goarch}
+	goExe, err := localGoExe(goVersion)
+	if err != nil {
+		res.ErrorInfo = newPlayError(phaseBuild, err.Error())
+		return res, nil
+	}
+	res.GoVersion = goVersionOf(goExe)
+	files, err := splitFiles([]byte(body))
+	if err != nil {
+		res.ErrorInfo = newPlayError(phaseBuild, err.Error())
+		return res, nil
+	}
+	pd, err := writeProgramDir(goExe, files)
+	if err != nil {
+		return nil, err
+	}
+	defer pd.Remove()
+
+	goos := "linux"
+	if goarch == "wasm" {
+		goos = "js"
+	}
+	env := append(goToolEnv(), "GOOS="+goos, "GOARCH="+goarch)
+	build := func(gcflags ...string) (string, error) {
+		args := []string{"build", "-trimpath", "-o", os.DevNull}
+		if pd.IsTest {
+			args = []string{"test", "-c", "-vet=off", "-trimpath", "-o", os.DevNull}
+		}
+		args = append(args, gcflags...)
+		args = append(args, ".")
+		ctx, cancel := context.WithTimeout(ctx, goBuildTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, goExe, args...)
+		cmd.Dir = pd.Dir
+		cmd.Env = env
+		out, err := cmd.CombinedOutput()
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return string(out), err
+	}
+
+	// only for packages in the snippet, not the standard library
+	out, err := build("-gcflags=./...=-S -m")
+	if err == nil {
+		parseAsmOutput(out, pd, res)
+		return res, nil
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return nil, err
+	}
+	// errors are mixed with assembly of packages that did compile
+	// so we build again without -S to get just the errors
+	out, err = build()
+	if err != nil && !errors.As(err, &exitErr) {
+		return nil, err
+	}
+	info := newPlayError(phaseBuild, pd.cleanOutput(out))
+	setEndPositions(info.Diagnostics, files)
+	res.ErrorInfo = info
+	return res, nil
+}
+
+// POST /api/goplay/asm?arch=${goarch}&go=${version}
+func asmHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	goarch := r.FormValue("arch")
+	if goarch == "" {
+		goarch = "amd64"
+	}
+	if !slices.Contains(asmArchs, goarch) {
+		http.Error(w, "Unsupported arch, must be one of: "+strings.Join(asmArchs, ", "), http.StatusBadRequest)
+		return
+	}
+	bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, maxSnippetSize+1))
+	if err != nil {
+		http.Error(w, "Failed to read request data", http.StatusInternalServerError)
+		return
+	}
+	if len(bodyBytes) > maxSnippetSize {
+		http.Error(w, "Snippet is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	release := acquireRunSlot(w, r)
+	if release == nil {
+		return
+	}
+	defer release()
+	res, err := compileAsm(r.Context(), string(bodyBytes), r.FormValue("go"), goarch)
+	if errors.Is(err, context.DeadlineExceeded) {
+		msg := "timeout compiling program"
+		res, err = &AsmResponse{GOARCH: goarch, ErrorInfo: newPlayError(phaseTimeout, msg)}, nil
+	}
+	if err != nil {
+		logf("asmHandler: compileAsm() failed with '%s'\n", err)
+		http.Error(w, "Failed to compile source code", http.StatusInternalServerError)
+		return
+	}
+	d, err := json.Marshal(res)
+	must(err)
+	serveJSON(w, d)
+}
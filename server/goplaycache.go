@@ -0,0 +1,507 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// results of running Go code are cached so that re-running unchanged
+// code doesn't build and run it again
+
+const defaultGoRunCacheSize = 256
+
+// resultsCache is a LRU cache of CompileResponse.
+// If dir is not empty, the entries are also saved as ${dir}/${key}.json
+type resultsCache struct {
+	mu      sync.Mutex
+	maxSize int
+	dir     string
+	// values are *cacheEntry, most recently used at the front
+	lru   *list.List
+	byKey map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key string
+	res *CompileResponse
+}
+
+func newResultsCache(maxSize int, dir string) *resultsCache {
+	c := &resultsCache{
+		maxSize: maxSize,
+		dir:     dir,
+		lru:     list.New(),
+		byKey:   map[string]*list.Element{},
+	}
+	if dir != "" {
+		c.loadFromDir()
+	}
+	return c
+}
+
+func (c *resultsCache) entryPath(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+// loadFromDir loads most recently saved entries, deletes the rest
+func (c *resultsCache) loadFromDir() {
+	err := os.MkdirAll(c.dir, 0755)
+	must(err)
+	entries, err := os.ReadDir(c.dir)
+	must(err)
+	type fileInfo struct {
+		key     string
+		modTime time.Time
+	}
+	var files []fileInfo
+	for _, de := range entries {
+		name := de.Name()
+		if filepath.Ext(name) != ".json" {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, fileInfo{key: name[:len(name)-len(".json")], modTime: info.ModTime()})
+	}
+	// most recent first
+	slices.SortFunc(files, func(a, b fileInfo) int {
+		return b.modTime.Compare(a.modTime)
+	})
+	for i, fi := range files {
+		path := c.entryPath(fi.key)
+		if i >= c.maxSize {
+			os.Remove(path)
+			continue
+		}
+		d, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		res := &CompileResponse{}
+		if json.Unmarshal(d, res) != nil {
+			os.Remove(path)
+			continue
+		}
+		el := c.lru.PushBack(&cacheEntry{key: fi.key, res: res})
+		c.byKey[fi.key] = el
+	}
+	logf("resultsCache: loaded %d entries from '%s'\n", c.lru.Len(), c.dir)
+}
+
+func (c *resultsCache) Get(key string) *CompileResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el := c.byKey[key]
+	if el == nil {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry).res
+}
+
+func (c *resultsCache) Put(key string, res *CompileResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el := c.byKey[key]; el != nil {
+		el.Value.(*cacheEntry).res = res
+		c.lru.MoveToFront(el)
+	} else {
+		c.byKey[key] = c.lru.PushFront(&cacheEntry{key: key, res: res})
+	}
+	for c.lru.Len() > c.maxSize {
+		el := c.lru.Back()
+		ce := c.lru.Remove(el).(*cacheEntry)
+		delete(c.byKey, ce.key)
+		if c.dir != "" {
+			os.Remove(c.entryPath(ce.key))
+		}
+	}
+	if c.dir != "" {
+		d, err := json.Marshal(res)
+		must(err)
+		err = os.WriteFile(c.entryPath(key), d, 0644)
+		logIfErrf(err)
+	}
+}
+
+// Purge removes all entries, returns how many were removed
+func (c *resultsCache) Purge() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.lru.Len()
+	c.lru.Init()
+	clear(c.byKey)
+	if c.dir != "" {
+		os.RemoveAll(c.dir)
+		err := os.MkdirAll(c.dir, 0755)
+		logIfErrf(err)
+	}
+	return n
+}
+
+var (
+	goRunCache     *resultsCache
+	goRunCacheOnce sync.Once
+)
+
+// returns nil if caching is disabled
+func getGoRunCache() *resultsCache {
+	goRunCacheOnce.Do(func() {
+		size := config.GoRunCacheSize
+		if size < 0 {
+			return
+		}
+		if size == 0 {
+			size = defaultGoRunCacheSize
+		}
+		dir := ""
+		if config.GoRunCachePersist {
+			dir = filepath.Join(getDataDirMust(), "goplay-cache")
+		}
+		goRunCache = newResultsCache(size, dir)
+	})
+	return goRunCache
+}
+
+// cacheKey is a hash of everything that affects the result of running the code.
+// goVersion is the exact version that runs the code so that results from
+// before upgrading go are not used. goSum is go.sum of the program after
+// resolving modules because new versions of modules change the result
+func (req *runRequest) cacheKey(backend string, goVersion string, goSum []byte) string {
+	d, err := json.Marshal(req)
+	must(err)
+	h := sha256.New()
+	h.Write([]byte(backend))
+	h.Write([]byte{0})
+	h.Write([]byte(goVersion))
+	h.Write([]byte{0})
+	h.Write(d)
+	h.Write([]byte{0})
+	h.Write(goSum)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isModuleImport returns true for packages that are not in std
+// e.g. "github.com/google/uuid"
+func isModuleImport(path string) bool {
+	first, _, _ := strings.Cut(path, "/")
+	return strings.Contains(first, ".")
+}
+
+// importsModules returns true if the program imports third-party modules
+func importsModules(files *programFiles) bool {
+	for _, name := range files.names {
+		if filepath.Ext(name) != ".go" {
+			continue
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), name, files.data[name], parser.ImportsOnly)
+		if err != nil {
+			continue
+		}
+		for _, imp := range f.Imports {
+			path, _ := strconv.Unquote(imp.Path.Value)
+			if isModuleImport(path) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolvedGoSum returns go.sum of the program after resolving its modules
+// the same way the local runner does
+func resolvedGoSum(version string, files *programFiles) ([]byte, error) {
+	goExe, err := localGoExe(version)
+	if err != nil {
+		return nil, err
+	}
+	pd, err := writeProgramDir(goExe, files)
+	if err != nil {
+		return nil, err
+	}
+	defer pd.Remove()
+	d, err := os.ReadFile(filepath.Join(pd.Dir, "go.sum"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return d, nil
+}
+
+// resolveGoVersion returns exact version of go that runs the code
+// for requested version e.g. "go1.22.3" for "go1.22"
+func resolveGoVersion(backend string, version string) (string, error) {
+	if backend == "local" {
+		goExe, err := localGoExe(version)
+		if err != nil {
+			return "", err
+		}
+		v := goVersionOf(goExe)
+		if v == "" {
+			return "", e("failed to get version of '%s'", goExe)
+		}
+		return v, nil
+	}
+	upstreamBackend, err := upstreamBackendForVersion(version)
+	if err != nil {
+		return "", err
+	}
+	v, err := getUpstreamVersion(upstreamBackend)
+	if err != nil {
+		return "", err
+	}
+	return v.Version, nil
+}
+
+// packages that make the output of a program depend on more than its source
+// play.golang.org fakes time and randomness so all upstream results are cacheable
+var nonDeterministicImports = []string{
+	"crypto/rand",
+	"math/rand",
+	"math/rand/v2",
+	"net",
+	"net/http",
+	"os",
+	"os/exec",
+	"runtime",
+	"time",
+}
+
+// isDeterministic guesses if running the program twice gives the same output.
+// To be safe, programs that start goroutines, use select or range over maps
+// or iterators are treated as non-deterministic
+func isDeterministic(files *programFiles) bool {
+	fset := token.NewFileSet()
+	var rootFiles []*ast.File
+	for _, name := range files.names {
+		if filepath.Ext(name) != ".go" {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, files.data[name], parser.SkipObjectResolution)
+		if err != nil {
+			return false
+		}
+		for _, imp := range f.Imports {
+			path, _ := strconv.Unquote(imp.Path.Value)
+			if slices.Contains(nonDeterministicImports, path) {
+				return false
+			}
+		}
+		if hasConcurrency(f) {
+			return false
+		}
+		if strings.Contains(name, "/") {
+			// we only type-check package main so we can't tell
+			// what other packages range over
+			if hasRange(f) {
+				return false
+			}
+			continue
+		}
+		rootFiles = append(rootFiles, f)
+	}
+	return !hasUnorderedRange(fset, rootFiles)
+}
+
+// hasConcurrency returns true if the code has go or select statements
+func hasConcurrency(f *ast.File) bool {
+	found := false
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n.(type) {
+		case *ast.GoStmt, *ast.SelectStmt:
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+func hasRange(f *ast.File) bool {
+	found := false
+	ast.Inspect(f, func(n ast.Node) bool {
+		if _, ok := n.(*ast.RangeStmt); ok {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+var (
+	muStdImporter sync.Mutex
+	stdImporter   types.Importer
+)
+
+// stdOnlyImporter imports packages from std using export data of the
+// local go. Third-party and local packages fail to import and expressions
+// using them have invalid type
+type stdOnlyImporter struct{}
+
+func (stdOnlyImporter) Import(path string) (*types.Package, error) {
+	if isModuleImport(path) || strings.HasPrefix(path, "play/") {
+		return nil, e("package '%s' is not in std", path)
+	}
+	muStdImporter.Lock()
+	defer muStdImporter.Unlock()
+	if stdImporter == nil {
+		stdImporter = importer.ForCompiler(token.NewFileSet(), "gc", nil)
+	}
+	return stdImporter.Import(path)
+}
+
+// hasUnorderedRange returns true if the code ranges over a map, an iterator
+// or something we don't know the type of
+func hasUnorderedRange(fset *token.FileSet, files []*ast.File) bool {
+	info := &types.Info{
+		Types: map[ast.Expr]types.TypeAndValue{},
+	}
+	conf := types.Config{
+		Importer: stdOnlyImporter{},
+		// keep going after errors, unknown types are treated as unordered
+		Error: func(err error) {},
+	}
+	conf.Check("main", fset, files, info)
+	found := false
+	for _, f := range files {
+		ast.Inspect(f, func(n ast.Node) bool {
+			rs, ok := n.(*ast.RangeStmt)
+			if !ok {
+				return !found
+			}
+			tv, ok := info.Types[rs.X]
+			if !ok || tv.Type == nil {
+				found = true
+				return false
+			}
+			switch t := tv.Type.Underlying().(type) {
+			case *types.Map, *types.Signature:
+				found = true
+			case *types.Basic:
+				if t.Kind() == types.Invalid {
+					found = true
+				}
+			}
+			return !found
+		})
+	}
+	return found
+}
+
+// cachingGoRunner returns cached results of deterministic programs
+type cachingGoRunner struct {
+	r     goRunner
+	cache *resultsCache
+	// name of the backend, part of cache key
+	backend string
+}
+
+func (c *cachingGoRunner) Run(ctx context.Context, req *runRequest, onEvent func(*CompileEvent)) (*CompileResponse, error) {
+	goVersion, err := resolveGoVersion(c.backend, req.GoVersion)
+	if err != nil {
+		// the runner reports the error
+		return c.r.Run(ctx, req, onEvent)
+	}
+	// with the proxy, the same code can resolve to newer versions of modules
+	var goSum []byte
+	if c.backend == "local" && isGoProxyEnabled() {
+		files, err := splitFiles([]byte(req.Body))
+		if err == nil && importsModules(files) {
+			goSum, err = resolvedGoSum(req.GoVersion, files)
+			if err != nil {
+				return c.r.Run(ctx, req, onEvent)
+			}
+		}
+	}
+	key := req.cacheKey(c.backend, goVersion, goSum)
+	if res := c.cache.Get(key); res != nil {
+		logf("cachingGoRunner: using cached result for %s\n", key[:8])
+		if onEvent != nil {
+			for _, ev := range res.Events {
+				onEvent(ev)
+			}
+		}
+		cached := *res
+		cached.Cached = true
+		return &cached, nil
+	}
+	res, err := c.r.Run(ctx, req, onEvent)
+	if err != nil || ctx.Err() != nil || !c.isCacheable(req, res) {
+		return res, err
+	}
+	// callers modify the result e.g. set Body
+	stored := *res
+	c.cache.Put(key, &stored)
+	return res, nil
+}
+
+func (c *cachingGoRunner) isCacheable(req *runRequest, res *CompileResponse) bool {
+	// -1 means killed: timeout, cancelled, too much output etc.
+	if res.Status == -1 {
+		return false
+	}
+	// only failures caused by the code are cacheable, not e.g. building
+	// taking too long because the machine was busy
+	if res.ErrorInfo != nil && res.ErrorInfo.Phase != phaseBuild && res.ErrorInfo.Phase != phaseRun {
+		return false
+	}
+	// compilation errors are always the same but resolving modules
+	// can fail because the proxy is unavailable
+	if res.Errors != "" {
+		return !strings.HasPrefix(res.Errors, "go: ")
+	}
+	if req.Options.isBuildOnly() {
+		return true
+	}
+	// benchmark results depend on how busy the machine is
+	if res.Tests != nil {
+		for _, t := range res.Tests.Tests {
+			if isTestName(t.Name, "Benchmark") {
+				return false
+			}
+		}
+	}
+	// races are found only when they happen
+	if req.Options != nil && req.Options.Race {
+		return false
+	}
+	if c.backend != "local" {
+		return true
+	}
+	files, err := splitFiles([]byte(req.Body))
+	return err == nil && isDeterministic(files)
+}
+
+// POST /api/goplay/cache/purge
+func purgeCacheHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdminRequest(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	n := 0
+	if c := getGoRunCache(); c != nil {
+		n = c.Purge()
+	}
+	logf("purgeCacheHandler: removed %d entries\n", n)
+	serveJSON(w, []byte(f(`{"Removed":%d}`, n)))
+}
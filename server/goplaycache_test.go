@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIsDeterministic(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want bool
+	}{
+		{
+			name: "hello world",
+			body: "package main\n\nimport \"fmt\"\n\nfunc main() { fmt.Println(\"hi\") }\n",
+			want: true,
+		},
+		{
+			name: "range over slice and int",
+			body: "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfor i, s := range []string{\"a\"} { fmt.Println(i, s) }\n\tfor i := range 3 { fmt.Println(i) }\n}\n",
+			want: true,
+		},
+		{
+			name: "printing a map",
+			body: "package main\n\nimport \"fmt\"\n\nfunc main() { fmt.Println(map[string]int{\"a\": 1, \"b\": 2}) }\n",
+			want: true,
+		},
+		{
+			name: "imports time",
+			body: "package main\n\nimport \"time\"\n\nfunc main() { println(time.Now().Unix()) }\n",
+		},
+		{
+			name: "go statement",
+			body: "package main\n\nfunc main() {\n\tgo println(1)\n\tprintln(2)\n}\n",
+		},
+		{
+			name: "select",
+			body: "package main\n\nfunc main() {\n\tc := make(chan int, 1)\n\tc <- 1\n\tselect {\n\tcase v := <-c:\n\t\tprintln(v)\n\t}\n}\n",
+		},
+		{
+			name: "range over map",
+			body: "package main\n\ntype M map[string]int\n\nfunc main() {\n\tfor k := range (M{\"a\": 1, \"b\": 2}) { println(k) }\n}\n",
+		},
+		{
+			name: "range over iterator",
+			body: "package main\n\nimport \"maps\"\n\nfunc main() {\n\tfor k := range maps.Keys(map[string]int{\"a\": 1}) { println(k) }\n}\n",
+		},
+		{
+			name: "range over value from a module",
+			body: "package main\n\nimport \"example.com/m\"\n\nfunc main() {\n\tfor k := range m.Values() { println(k) }\n}\n",
+		},
+		{
+			name: "range in another package",
+			body: "-- prog.go --\npackage main\n\nimport \"play/util\"\n\nfunc main() { util.F() }\n-- util/util.go --\npackage util\n\nfunc F() {\n\tfor i := range []int{1} { println(i) }\n}\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := splitFiles([]byte(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := isDeterministic(files); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
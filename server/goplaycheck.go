@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"go/scanner"
+	"go/token"
+	"io"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Diagnostic is a problem in the source code, reported by the compiler or vet.
+// Lines and columns are 1-based, columns are in bytes
+type Diagnostic struct {
+	File      string
+	Line      int
+	Column    int
+	EndLine   int
+	EndColumn int
+	// "error" for compiler errors, "warning" for vet
+	Severity string
+	// "compiler" or name of vet analyzer e.g. "printf"
+	Source  string
+	Message string
+}
+
+// CheckResponse is the response of /api/goplay/check
+type CheckResponse struct {
+	Diagnostics []*Diagnostic
+	// set if we couldn't check the code e.g. timeout
+	Error     string     `json:",omitempty"`
+	ErrorInfo *PlayError `json:",omitempty"`
+}
+
+// "./prog.go:5:2: undefined: x"
+var rxCompilerError = regexp.MustCompile(`^(\S+?\.go):(\d+):(\d+): (.*)$`)
+
+// parseCompilerErrors parses output of go build
+func parseCompilerErrors(out string, pd *programDir) []*Diagnostic {
+	return parseDiagnostics(pd.cleanOutput(out))
+}
+
+// vetDiagnostic is the format of go vet -json
+type vetDiagnostic struct {
+	Posn    string `json:"posn"`
+	End     string `json:"end"`
+	Message string `json:"message"`
+}
+
+// "/tmp/dir/prog.go:5:2" => "prog.go", 5, 2
+func parsePosn(posn string, pd *programDir) (string, int, int) {
+	parts := strings.Split(posn, ":")
+	if len(parts) < 3 {
+		return pd.fileName(posn), 0, 0
+	}
+	n := len(parts)
+	line, _ := strconv.Atoi(parts[n-2])
+	col, _ := strconv.Atoi(parts[n-1])
+	return pd.fileName(strings.Join(parts[:n-2], ":")), line, col
+}
+
+// parseVetJSON parses output of go vet -json which looks like:
+// # play
+// { "play": { "printf": [ { "posn": "...", "message": "..." } ] } }
+func parseVetJSON(out string, pd *programDir) ([]*Diagnostic, error) {
+	var res []*Diagnostic
+	dec := json.NewDecoder(strings.NewReader(removeBuildHeaders(out)))
+	for {
+		var byPkg map[string]map[string]json.RawMessage
+		err := dec.Decode(&byPkg)
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, byAnalyzer := range byPkg {
+			for analyzer, raw := range byAnalyzer {
+				var diags []*vetDiagnostic
+				// when analyzer fails the value is {"error": "..."}
+				if json.Unmarshal(raw, &diags) != nil {
+					continue
+				}
+				for _, vd := range diags {
+					d := &Diagnostic{
+						Severity: "warning",
+						Source:   analyzer,
+						Message:  vd.Message,
+					}
+					d.File, d.Line, d.Column = parsePosn(vd.Posn, pd)
+					if vd.End != "" {
+						_, d.EndLine, d.EndColumn = parsePosn(vd.End, pd)
+					}
+					res = append(res, d)
+				}
+			}
+		}
+	}
+}
+
+func removeBuildHeaders(out string) string {
+	var lines []string
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, "# ") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// setEndPositions sets end of diagnostics that don't have it to the end of
+// the token at the start position so that the editor can underline it
+func setEndPositions(diags []*Diagnostic, files *programFiles) {
+	for name, src := range files.data {
+		if !strings.HasSuffix(name, ".go") {
+			continue
+		}
+		var fileDiags []*Diagnostic
+		for _, d := range diags {
+			if d.File == name && d.EndLine == 0 {
+				fileDiags = append(fileDiags, d)
+			}
+		}
+		if len(fileDiags) > 0 {
+			setEndPositionsInFile(fileDiags, name, src)
+		}
+	}
+	// in files we don't have e.g. go.mod
+	for _, d := range diags {
+		if d.EndLine == 0 {
+			d.EndLine, d.EndColumn = d.Line, d.Column
+		}
+	}
+}
+
+func setEndPositionsInFile(diags []*Diagnostic, fileName string, src []byte) {
+	fset := token.NewFileSet()
+	file := fset.AddFile(fileName, -1, len(src))
+	var s scanner.Scanner
+	s.Init(file, src, nil, scanner.ScanComments)
+	type tokenPos struct {
+		line, col       int
+		endLine, endCol int
+	}
+	var toks []tokenPos
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		n := len(lit)
+		if n == 0 {
+			n = len(tok.String())
+		}
+		// automatically inserted semicolon has lit "\n"
+		if tok == token.SEMICOLON && lit == "\n" {
+			continue
+		}
+		start := fset.Position(pos)
+		end := fset.Position(file.Pos(min(file.Offset(pos)+n, len(src))))
+		toks = append(toks, tokenPos{start.Line, start.Column, end.Line, end.Column})
+	}
+	for _, d := range diags {
+		d.EndLine, d.EndColumn = d.Line, d.Column
+		for _, t := range toks {
+			if t.line == d.Line && t.col == d.Column {
+				d.EndLine, d.EndColumn = t.endLine, t.endCol
+				break
+			}
+		}
+	}
+}
+
+func newCheckError(msg string) *CheckResponse {
+	return &CheckResponse{Error: msg, ErrorInfo: newPlayError(phaseBuild, msg)}
+}
+
+// checkGo type-checks the program and, if there are no errors, runs go vet
+func checkGo(ctx context.Context, body string, goVersion string) (*CheckResponse, error) {
+	goExe, err := localGoExe(goVersion)
+	if err != nil {
+		return newCheckError(err.Error()), nil
+	}
+	files, err := splitFiles([]byte(body))
+	if err != nil {
+		return newCheckError(err.Error()), nil
+	}
+	pd, err := writeProgramDir(goExe, files)
+	if err != nil {
+		return nil, err
+	}
+	defer pd.Remove()
+	dir, isTest := pd.Dir, pd.IsTest
+
+	ctx, cancel := context.WithTimeout(ctx, goBuildTimeout)
+	defer cancel()
+	run := func(args ...string) (string, error) {
+		cmd := exec.CommandContext(ctx, goExe, args...)
+		cmd.Dir = dir
+		cmd.Env = goToolEnv()
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		err := cmd.Run()
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		var exitErr *exec.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			return "", err
+		}
+		return out.String(), nil
+	}
+
+	res := &CheckResponse{}
+	// -e reports all errors, not just first 10
+	// ./... so that we check all packages in txtar snippets
+	exe := filepath.Join(dir, "prog")
+	buildArgs := []string{"build", "-gcflags=-e", "./..."}
+	if isTest {
+		buildArgs = []string{"test", "-c", "-vet=off", "-gcflags=-e", "-o", exe, "."}
+	}
+	out, err := run(buildArgs...)
+	if err != nil {
+		return nil, err
+	}
+	res.Diagnostics = parseCompilerErrors(out, pd)
+	if len(res.Diagnostics) == 0 {
+		// vet requires code that type-checks
+		out, err = run("vet", "-json", "./...")
+		if err != nil {
+			return nil, err
+		}
+		res.Diagnostics, err = parseVetJSON(out, pd)
+		if err != nil {
+			logf("checkGo: parseVetJSON() failed with '%s', output:\n%s\n", err, out)
+			return nil, err
+		}
+	}
+	setEndPositions(res.Diagnostics, files)
+	if res.Diagnostics == nil {
+		res.Diagnostics = []*Diagnostic{}
+	}
+	return res, nil
+}
+
+// POST /api/goplay/check
+// type-checks and vets the code without running it. Always uses
+// local go toolchain
+func checkHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, maxSnippetSize+1))
+	if err != nil {
+		http.Error(w, "Failed to read request data", http.StatusInternalServerError)
+		return
+	}
+	if len(bodyBytes) > maxSnippetSize {
+		http.Error(w, "Snippet is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	release := acquireRunSlot(w, r)
+	if release == nil {
+		return
+	}
+	defer release()
+	res, err := checkGo(r.Context(), string(bodyBytes), r.FormValue("go"))
+	if errors.Is(err, context.DeadlineExceeded) {
+		msg := "timeout checking program"
+		res, err = &CheckResponse{Error: msg, ErrorInfo: newPlayError(phaseTimeout, msg)}, nil
+	}
+	if err != nil {
+		logf("checkHandler: checkGo() failed with '%s'\n", err)
+		http.Error(w, "Failed to check source code", http.StatusInternalServerError)
+		return
+	}
+	if !wantsLegacyErrors(r) {
+		res.Error = ""
+	}
+	d, err := json.Marshal(res)
+	must(err)
+	serveJSON(w, d)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// when running tests we collect coverage so that the editor can shade
+// covered and uncovered lines of the block
+
+// LineCoverage is how many times statements on a line were executed.
+// Only lines with statements are reported
+type LineCoverage struct {
+	Line  int
+	Count int
+}
+
+// FileCoverage is coverage of a single file of the snippet
+type FileCoverage struct {
+	File  string
+	Lines []*LineCoverage
+}
+
+// CoverageReport is coverage of the code by tests
+type CoverageReport struct {
+	// percentage of statements executed, like in go test -cover output
+	Percent    float64
+	Statements int
+	Covered    int
+	Files      []*FileCoverage
+}
+
+// name of the coverage profile in the program's directory
+const coverProfileName = "cover.out"
+
+// go test doesn't instrument _test.go files but the code and its tests
+// are usually in prog.go. splitTests moves non-test code of prog_test.go
+// to prog.go so that it can be instrumented. Declarations are replaced
+// with spaces so that lines and columns don't change.
+// Returns false if there's nothing to split
+func (pd *programDir) splitTests() (bool, error) {
+	if !pd.IsTest {
+		return false, nil
+	}
+	src, ok := pd.Files.data[progName]
+	if !ok {
+		return false, nil
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, progName, src, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		// go build will report syntax errors
+		return false, nil
+	}
+	code := bytes.Clone(src)
+	tests := bytes.Clone(src)
+	var codeDecls, testDecls []ast.Decl
+	for _, decl := range f.Decls {
+		if gd, ok := decl.(*ast.GenDecl); ok && gd.Tok == token.IMPORT {
+			continue
+		}
+		// blank the doc comment together with the declaration
+		start := decl.Pos()
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Doc != nil {
+			start = fn.Doc.Pos()
+		}
+		if gd, ok := decl.(*ast.GenDecl); ok && gd.Doc != nil {
+			start = gd.Doc.Pos()
+		}
+		from, to := fset.Position(start).Offset, fset.Position(decl.End()).Offset
+		if isTestFunc(decl) {
+			testDecls = append(testDecls, decl)
+			blankOut(code[from:to])
+		} else {
+			codeDecls = append(codeDecls, decl)
+			blankOut(tests[from:to])
+		}
+	}
+	if len(codeDecls) == 0 || len(testDecls) == 0 {
+		return false, nil
+	}
+	code = blankUnusedImports(code, fset, f, codeDecls)
+	tests = blankUnusedImports(tests, fset, f, testDecls)
+	err = os.WriteFile(filepath.Join(pd.Dir, progName), code, 0644)
+	if err != nil {
+		return false, err
+	}
+	err = os.WriteFile(filepath.Join(pd.Dir, testProgName), tests, 0644)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// undoSplitTests restores prog_test.go written by splitTests
+func (pd *programDir) undoSplitTests() error {
+	err := os.Remove(filepath.Join(pd.Dir, progName))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(pd.Dir, testProgName), pd.Files.data[progName], 0644)
+}
+
+func isTestFunc(decl ast.Decl) bool {
+	fn, ok := decl.(*ast.FuncDecl)
+	if !ok || fn.Recv != nil {
+		return false
+	}
+	name := fn.Name.Name
+	return isTestName(name, "Test") || isTestName(name, "Example") || isTestName(name, "Benchmark") || isTestName(name, "Fuzz")
+}
+
+// blankOut replaces everything but newlines with spaces
+func blankOut(d []byte) {
+	for i, c := range d {
+		if c != '\n' {
+			d[i] = ' '
+		}
+	}
+}
+
+// "gopkg.in/yaml.v3" => "yaml", "math/rand/v2" => "rand"
+var rxImportVersion = regexp.MustCompile(`^v\d+$`)
+
+// importName guesses the name of the imported package from its path. If
+// the guess is wrong the code doesn't compile and we run it without coverage
+func importName(spec *ast.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name
+	}
+	p, _ := strconv.Unquote(spec.Path.Value)
+	name := path.Base(p)
+	if rxImportVersion.MatchString(name) && path.Dir(p) != "." {
+		name = path.Base(path.Dir(p))
+	}
+	name, _, _ = strings.Cut(name, ".")
+	name = strings.TrimPrefix(name, "go-")
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// blankUnusedImports changes imports not used by decls to _ imports
+func blankUnusedImports(src []byte, fset *token.FileSet, f *ast.File, decls []ast.Decl) []byte {
+	used := map[string]bool{}
+	for _, decl := range decls {
+		ast.Inspect(decl, func(n ast.Node) bool {
+			if sel, ok := n.(*ast.SelectorExpr); ok {
+				if id, ok := sel.X.(*ast.Ident); ok {
+					used[id.Name] = true
+				}
+			}
+			return true
+		})
+	}
+	var res []byte
+	last := 0
+	for _, spec := range f.Imports {
+		name := importName(spec)
+		if name == "_" || name == "." || used[name] {
+			continue
+		}
+		from := fset.Position(spec.Path.Pos()).Offset
+		if spec.Name != nil {
+			from = fset.Position(spec.Name.Pos()).Offset
+		}
+		to := fset.Position(spec.Path.Pos()).Offset
+		res = append(res, src[last:from]...)
+		res = append(res, "_ "...)
+		last = to
+	}
+	return append(res, src[last:]...)
+}
+
+// coverBlock is a single line of the coverage profile:
+// "play/prog.go:4.3,5.1 1 1"
+type coverBlock struct {
+	file      string
+	startLine int
+	startCol  int
+	endLine   int
+	endCol    int
+	stmts     int
+}
+
+var rxCoverBlock = regexp.MustCompile(`^(.+):(\d+)\.(\d+),(\d+)\.(\d+) (\d+) (\d+)$`)
+
+// parseCoverProfile returns coverage of files in the snippet from
+// the profile written by -test.coverprofile
+func parseCoverProfile(d []byte, pd *programDir) *CoverageReport {
+	// with -coverpkg the same block can be reported more than once
+	counts := map[coverBlock]int{}
+	var blocks []coverBlock
+	modPath := pd.modulePath()
+	sc := bufio.NewScanner(bytes.NewReader(d))
+	for sc.Scan() {
+		m := rxCoverBlock.FindStringSubmatch(sc.Text())
+		if m == nil {
+			// "mode: count" header
+			continue
+		}
+		name := pd.asmFileName(m[1], modPath)
+		if name == "" {
+			continue
+		}
+		b := coverBlock{file: name}
+		b.startLine, _ = strconv.Atoi(m[2])
+		b.startCol, _ = strconv.Atoi(m[3])
+		b.endLine, _ = strconv.Atoi(m[4])
+		b.endCol, _ = strconv.Atoi(m[5])
+		b.stmts, _ = strconv.Atoi(m[6])
+		count, _ := strconv.Atoi(m[7])
+		prev, ok := counts[b]
+		if !ok {
+			blocks = append(blocks, b)
+		}
+		counts[b] = max(prev, count)
+	}
+
+	res := &CoverageReport{}
+	lines := map[string]map[int]int{}
+	for _, b := range blocks {
+		count := counts[b]
+		res.Statements += b.stmts
+		if count > 0 {
+			res.Covered += b.stmts
+		}
+		fileLines := lines[b.file]
+		if fileLines == nil {
+			fileLines = map[int]int{}
+			lines[b.file] = fileLines
+		}
+		endLine := b.endLine
+		// block ends before the first character of the line e.g. before "}"
+		if b.endCol <= 1 && endLine > b.startLine {
+			endLine--
+		}
+		for line := b.startLine; line <= endLine; line++ {
+			prev, ok := fileLines[line]
+			if !ok || count > prev {
+				fileLines[line] = count
+			}
+		}
+	}
+	if res.Statements > 0 {
+		percent := float64(res.Covered) * 100 / float64(res.Statements)
+		res.Percent = math.Round(percent*10) / 10
+	}
+	for _, name := range pd.Files.names {
+		fileLines, ok := lines[name]
+		if !ok {
+			continue
+		}
+		fc := &FileCoverage{File: name}
+		for line, count := range fileLines {
+			fc.Lines = append(fc.Lines, &LineCoverage{Line: line, Count: count})
+		}
+		slices.SortFunc(fc.Lines, func(a, b *LineCoverage) int {
+			return a.Line - b.Line
+		})
+		res.Files = append(res.Files, fc)
+	}
+	return res
+}
+
+// addCoverage adds coverage from the profile written by the test binary
+func addCoverage(res *CompileResponse, pd *programDir) {
+	d, err := os.ReadFile(filepath.Join(pd.Dir, coverProfileName))
+	if err != nil {
+		// e.g. the program crashed or timed out
+		return
+	}
+	cov := parseCoverProfile(d, pd)
+	if cov.Statements > 0 {
+		res.Coverage = cov
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// phases in which formatting or running Go code can fail
+const (
+	phaseFormat  = "format"
+	phaseBuild   = "build"
+	phaseRun     = "run"
+	phaseTimeout = "timeout"
+)
+
+// PlayError describes why formatting, building or running the code failed.
+// It's the same for all /api/goplay/ endpoints, in ErrorInfo field
+type PlayError struct {
+	// "format", "build", "run" or "timeout"
+	Phase string
+	// problems in the source code, parsed from compiler output
+	Diagnostics []*Diagnostic `json:",omitempty"`
+	// exit code of the program, only for "run" phase
+	ExitCode int `json:",omitempty"`
+	// error message as reported by the tool or upstream
+	Message string
+}
+
+func newPlayError(phase string, msg string) *PlayError {
+	res := &PlayError{
+		Phase:   phase,
+		Message: msg,
+	}
+	if phase == phaseFormat || phase == phaseBuild {
+		res.Diagnostics = parseDiagnostics(msg)
+	}
+	return res
+}
+
+// parseDiagnostics parses "prog.go:5:2: undefined: x" lines
+func parseDiagnostics(out string) []*Diagnostic {
+	var res []*Diagnostic
+	var last *Diagnostic
+	for _, line := range strings.Split(out, "\n") {
+		m := rxCompilerError.FindStringSubmatch(line)
+		if m == nil {
+			// continuation of the previous message, indented with a tab
+			if last != nil && strings.HasPrefix(line, "\t") {
+				last.Message += "\n" + strings.TrimSpace(line)
+			}
+			continue
+		}
+		d := &Diagnostic{
+			File:     strings.TrimPrefix(m[1], "./"),
+			Severity: "error",
+			Source:   "compiler",
+			Message:  m[4],
+		}
+		d.Line, _ = strconv.Atoi(m[2])
+		d.Column, _ = strconv.Atoi(m[3])
+		res = append(res, d)
+		last = d
+	}
+	return res
+}
+
+// setErrorInfo sets ErrorInfo from Error for responses that don't have it
+// e.g. from upstream
+func (res *FmtResponse) setErrorInfo() {
+	if res.ErrorInfo == nil && res.Error != "" {
+		res.ErrorInfo = newPlayError(phaseFormat, res.Error)
+	}
+}
+
+// setErrorInfo sets ErrorInfo from Errors and Status for responses that
+// don't have it e.g. from upstream
+func (res *CompileResponse) setErrorInfo() {
+	if res.ErrorInfo != nil {
+		return
+	}
+	switch {
+	case strings.HasPrefix(res.Errors, "timeout"):
+		res.ErrorInfo = newPlayError(phaseTimeout, res.Errors)
+	case res.Errors != "":
+		res.ErrorInfo = newPlayError(phaseBuild, res.Errors)
+	case res.Status != 0:
+		res.ErrorInfo = newRunError(res.Status, "")
+	}
+}
+
+func newRunError(exitCode int, msg string) *PlayError {
+	if msg == "" {
+		msg = "program exited with status " + strconv.Itoa(exitCode)
+	}
+	return &PlayError{
+		Phase:    phaseRun,
+		ExitCode: exitCode,
+		Message:  msg,
+	}
+}
+
+// wantsLegacyErrors returns false if the client only understands ErrorInfo.
+// For compatibility, by default we also send errors as strings in
+// Error (/api/goplay/fmt) and Errors (/api/goplay/compile) fields
+func wantsLegacyErrors(r *http.Request) bool {
+	return r.FormValue("errors") != "v2"
+}
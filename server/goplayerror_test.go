@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseDiagnostics(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []Diagnostic
+	}{
+		{
+			name: "no errors",
+			out:  "",
+		},
+		{
+			name: "build errors",
+			out:  "# play\n./prog.go:5:2: undefined: x\n./util/util.go:10:14: missing return\n",
+			want: []Diagnostic{
+				{File: "prog.go", Line: 5, Column: 2, Message: "undefined: x"},
+				{File: "util/util.go", Line: 10, Column: 14, Message: "missing return"},
+			},
+		},
+		{
+			name: "continuation lines",
+			out:  "prog.go:7:9: cannot use s (variable of type string) as int value in return statement\n\thave string\n\twant int\n",
+			want: []Diagnostic{
+				{File: "prog.go", Line: 7, Column: 9, Message: "cannot use s (variable of type string) as int value in return statement\nhave string\nwant int"},
+			},
+		},
+		{
+			name: "not compiler output",
+			out:  "go: example.com/x@v1.0.0: module lookup disabled by GOPROXY=off\n\tunexpected tab\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseDiagnostics(tt.out)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d diagnostics, want %d", len(got), len(tt.want))
+			}
+			for i, w := range tt.want {
+				w.Severity = "error"
+				w.Source = "compiler"
+				if *got[i] != w {
+					t.Errorf("diagnostic %d: got %+v, want %+v", i, *got[i], w)
+				}
+			}
+		})
+	}
+}
+
+func TestNewPlayError(t *testing.T) {
+	msg := "./prog.go:3:1: syntax error"
+	for _, phase := range []string{phaseFormat, phaseBuild} {
+		pe := newPlayError(phase, msg)
+		if pe.Phase != phase || pe.Message != msg || len(pe.Diagnostics) != 1 {
+			t.Errorf("newPlayError(%q): got %+v", phase, pe)
+		}
+	}
+	// output of the program is not parsed
+	if pe := newPlayError(phaseRun, msg); len(pe.Diagnostics) != 0 {
+		t.Errorf("newPlayError(%q): got diagnostics %+v", phaseRun, pe.Diagnostics)
+	}
+}
+
+func TestCompileResponseSetErrorInfo(t *testing.T) {
+	tests := []struct {
+		res       CompileResponse
+		wantPhase string
+		wantCode  int
+	}{
+		{CompileResponse{}, "", 0},
+		{CompileResponse{Errors: "timeout running program"}, phaseTimeout, 0},
+		{CompileResponse{Errors: "prog.go:1:1: expected 'package'"}, phaseBuild, 0},
+		{CompileResponse{Status: 2}, phaseRun, 2},
+	}
+	for _, tt := range tests {
+		res := tt.res
+		res.setErrorInfo()
+		if tt.wantPhase == "" {
+			if res.ErrorInfo != nil {
+				t.Errorf("%+v: got ErrorInfo %+v, want nil", tt.res, res.ErrorInfo)
+			}
+			continue
+		}
+		if res.ErrorInfo == nil || res.ErrorInfo.Phase != tt.wantPhase || res.ErrorInfo.ExitCode != tt.wantCode {
+			t.Errorf("%+v: got ErrorInfo %+v, want phase %q exit code %d", tt.res, res.ErrorInfo, tt.wantPhase, tt.wantCode)
+		}
+	}
+}
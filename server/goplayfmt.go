@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"go/scanner"
+	"strings"
+
+	"golang.org/x/tools/imports"
+)
+
+// name of the file used in error messages, same as play.golang.org
+const progName = "prog.go"
+
+// formatGoLocal formats the code like gofmt and fixes imports like goimports.
+// Problems with the source code are reported in FmtResponse.Error and
+// include line and column e.g. "prog.go:5:2: expected ';', found x".
+// Returned error means formatting couldn't be attempted
+func formatGoLocal(body string) (*FmtResponse, error) {
+	files, err := splitFiles([]byte(body))
+	if err != nil {
+		return &FmtResponse{Error: err.Error()}, nil
+	}
+	// format all .go files in txtar archive, leave the rest as is
+	for _, name := range files.names {
+		if !strings.HasSuffix(name, ".go") {
+			continue
+		}
+		// nil options are the same as goimports defaults
+		d, err := imports.Process(name, files.data[name], nil)
+		if err == nil {
+			files.data[name] = d
+			continue
+		}
+		var errList scanner.ErrorList
+		if errors.As(err, &errList) {
+			return newFmtErrorResponse(errList.Error(), errList...), nil
+		}
+		var scanErr *scanner.Error
+		if errors.As(err, &scanErr) {
+			return newFmtErrorResponse(scanErr.Error(), scanErr), nil
+		}
+		return nil, err
+	}
+	return &FmtResponse{Body: string(files.archive())}, nil
+}
+
+func newFmtErrorResponse(msg string, errs ...*scanner.Error) *FmtResponse {
+	info := &PlayError{
+		Phase:   phaseFormat,
+		Message: msg,
+	}
+	for _, e := range errs {
+		info.Diagnostics = append(info.Diagnostics, &Diagnostic{
+			File:     e.Pos.Filename,
+			Line:     e.Pos.Line,
+			Column:   e.Pos.Column,
+			Severity: "error",
+			Source:   "gofmt",
+			Message:  e.Msg,
+		})
+	}
+	return &FmtResponse{Error: msg, ErrorInfo: info}
+}
+
+func formatGoUpstream(body string, goVersion string) (*FmtResponse, error) {
+	backend, err := upstreamBackendForVersion(goVersion)
+	if err != nil {
+		return nil, err
+	}
+	d, err := runImports(&body, backend)
+	if err != nil {
+		return nil, err
+	}
+	res := &FmtResponse{}
+	err = json.Unmarshal(d, res)
+	if err != nil {
+		return nil, err
+	}
+	res.setErrorInfo()
+	return res, nil
+}
+
+// goVersion only matters when formatting upstream. Formatting locally
+// is done with the library so go version is that of the server
+func formatGo(body string, goVersion string) (*FmtResponse, error) {
+	res, err := formatGoLocal(body)
+	if err == nil {
+		// e.g. invalid txtar archive
+		res.setErrorInfo()
+		return res, nil
+	}
+	if !config.GoFmtUpstreamFallback {
+		return nil, err
+	}
+	logf("formatGo: formatGoLocal() failed with '%s', trying upstream\n", err)
+	return formatGoUpstream(body, goVersion)
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fuzzing is time-boxed, the client can ask for a duration between
+// fuzzTimeMin and Config.GoFuzzMaxTimeSec
+const (
+	fuzzTimeMin        = 10 * time.Second
+	fuzzTimeMaxDefault = 60 * time.Second
+	// by default go test spends up to 60s minimizing failing input
+	fuzzMinimizeTime = 10 * time.Second
+	// a bit more than size of the file shared by fuzz coordinator and worker
+	fuzzWorkerMemSize = 128 * 1024 * 1024
+)
+
+// FuzzProgress is sent periodically while fuzzing
+type FuzzProgress struct {
+	Elapsed     time.Duration
+	Execs       int64
+	ExecsPerSec int64
+	// number of inputs that increased coverage, the new ones are
+	// found by fuzzing, the rest are from seed corpus
+	NewInteresting   int
+	TotalInteresting int
+	// e.g. "gathering baseline coverage: 1/1 completed"
+	Message string `json:",omitempty"`
+}
+
+// FuzzCorpusEntry is an input that makes the fuzz target fail
+type FuzzCorpusEntry struct {
+	// e.g. "testdata/fuzz/FuzzReverse/1de061fa29cfbb3d"
+	// it can be added as a file to txtar snippet so that go test re-runs it
+	File    string
+	Content string
+}
+
+// FuzzExit is the last event sent by /api/goplay/fuzz
+type FuzzExit struct {
+	// name of the fuzz target e.g. "FuzzReverse"
+	Target   string
+	Status   int
+	Duration time.Duration
+	// true if fuzzing found input that makes the target fail
+	Crashed bool
+	// output of the failed target
+	Failure string           `json:",omitempty"`
+	Corpus  *FuzzCorpusEntry `json:",omitempty"`
+	// a test that calls the fuzz function with the failing input
+	Reproducer string     `json:",omitempty"`
+	GoVersion  string     `json:",omitempty"`
+	ErrorInfo  *PlayError `json:",omitempty"`
+}
+
+var (
+	// "fuzz: elapsed: 3s, execs: 1234 (411/sec), new interesting: 2 (total: 3)"
+	rxFuzzProgress = regexp.MustCompile(`^fuzz: elapsed: (\d+)s, execs: (\d+) \((\d+)/sec\), new interesting: (\d+) \(total: (\d+)\)`)
+	// "fuzz: elapsed: 0s, gathering baseline coverage: 0/1 completed"
+	rxFuzzMessage = regexp.MustCompile(`^fuzz: elapsed: (\d+)s, (.*)$`)
+)
+
+func parseFuzzProgress(line string) *FuzzProgress {
+	if m := rxFuzzProgress.FindStringSubmatch(line); m != nil {
+		res := &FuzzProgress{}
+		secs, _ := strconv.Atoi(m[1])
+		res.Elapsed = time.Duration(secs) * time.Second
+		res.Execs, _ = strconv.ParseInt(m[2], 10, 64)
+		res.ExecsPerSec, _ = strconv.ParseInt(m[3], 10, 64)
+		res.NewInteresting, _ = strconv.Atoi(m[4])
+		res.TotalInteresting, _ = strconv.Atoi(m[5])
+		return res
+	}
+	if m := rxFuzzMessage.FindStringSubmatch(line); m != nil {
+		secs, _ := strconv.Atoi(m[1])
+		return &FuzzProgress{
+			Elapsed: time.Duration(secs) * time.Second,
+			Message: m[2],
+		}
+	}
+	return nil
+}
+
+// fuzzLineWriter splits output into lines and calls onProgress for fuzz progress lines
+type fuzzLineWriter struct {
+	buf        bytes.Buffer
+	onProgress func(*FuzzProgress)
+}
+
+func (w *fuzzLineWriter) write(s string) {
+	w.buf.WriteString(s)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// incomplete line, wait for the rest
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			return
+		}
+		if p := parseFuzzProgress(strings.TrimSpace(line)); p != nil {
+			w.onProgress(p)
+		}
+	}
+}
+
+// fuzzFuncLit returns the function passed to f.Fuzz() in fuzz target fn
+func fuzzFuncLit(fn *ast.FuncDecl) *ast.FuncLit {
+	params := fn.Type.Params.List
+	if len(params) != 1 || len(params[0].Names) != 1 {
+		return nil
+	}
+	fName := params[0].Names[0].Name
+	var res *ast.FuncLit
+	ast.Inspect(fn.Body, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || res != nil || len(call.Args) != 1 {
+			return res == nil
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "Fuzz" {
+			return true
+		}
+		if x, ok := sel.X.(*ast.Ident); !ok || x.Name != fName {
+			return true
+		}
+		res, _ = call.Args[0].(*ast.FuncLit)
+		return false
+	})
+	return res
+}
+
+// fuzzTarget is a FuzzXxx(f *testing.F) function in the snippet
+type fuzzTarget struct {
+	name string
+	// source code of the function passed to f.Fuzz(), nil if not found
+	fuzzFunc []byte
+}
+
+// findFuzzTargets returns fuzz targets in root .go files of the snippet
+func findFuzzTargets(files *programFiles) []*fuzzTarget {
+	var res []*fuzzTarget
+	for _, name := range files.rootGoFiles() {
+		src := files.data[name]
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, name, src, parser.SkipObjectResolution)
+		if err != nil {
+			continue
+		}
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil || !isTestName(fn.Name.Name, "Fuzz") {
+				continue
+			}
+			t := &fuzzTarget{name: fn.Name.Name}
+			if lit := fuzzFuncLit(fn); lit != nil {
+				start, end := fset.Position(lit.Pos()).Offset, fset.Position(lit.End()).Offset
+				t.fuzzFunc = src[start:end]
+			}
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// fuzzReproducer returns a test that calls the fuzz function with the input
+// from corpus entry which looks like:
+// go test fuzz v1
+// string("x000")
+// int(5)
+func fuzzReproducer(target *fuzzTarget, entry *FuzzCorpusEntry) string {
+	if target.fuzzFunc == nil {
+		return ""
+	}
+	args := []string{"t"}
+	lines := strings.Split(strings.TrimSpace(entry.Content), "\n")
+	for _, line := range lines[1:] {
+		if line = strings.TrimSpace(line); line != "" {
+			args = append(args, line)
+		}
+	}
+	hash := path.Base(entry.File)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// reproduces failure of %s found by fuzzing\n", target.name)
+	fmt.Fprintf(&buf, "func Test%s_%s(t *testing.T) {\n", target.name, hash[:min(len(hash), 8)])
+	fmt.Fprintf(&buf, "\tfuzz := %s\n", target.fuzzFunc)
+	fmt.Fprintf(&buf, "\tfuzz(%s)\n", strings.Join(args, ", "))
+	buf.WriteString("}\n")
+	d, err := format.Source(buf.Bytes())
+	if err != nil {
+		return buf.String()
+	}
+	return string(d)
+}
+
+// readFailingInput returns corpus entry written by go test after a failure
+// the snippet might have its own seed corpus entries which we skip
+func readFailingInput(pd *programDir, target string) *FuzzCorpusEntry {
+	corpusDir := filepath.Join(pd.Dir, "testdata", "fuzz", target)
+	entries, err := os.ReadDir(corpusDir)
+	if err != nil {
+		return nil
+	}
+	for _, e := range entries {
+		name := path.Join("testdata", "fuzz", target, e.Name())
+		if _, ok := pd.Files.data[name]; ok {
+			continue
+		}
+		d, err := os.ReadFile(filepath.Join(corpusDir, e.Name()))
+		if err != nil {
+			return nil
+		}
+		return &FuzzCorpusEntry{
+			File:    name,
+			Content: string(d),
+		}
+	}
+	return nil
+}
+
+// fuzzTime returns how long to fuzz given ?time=${seconds}
+func fuzzTime(s string) time.Duration {
+	maxTime := fuzzTimeMaxDefault
+	if config.GoFuzzMaxTimeSec > 0 {
+		maxTime = time.Duration(config.GoFuzzMaxTimeSec) * time.Second
+	}
+	secs, err := strconv.Atoi(s)
+	if err != nil {
+		return min(30*time.Second, maxTime)
+	}
+	return min(max(time.Duration(secs)*time.Second, fuzzTimeMin), maxTime)
+}
+
+// fuzzGo builds the test binary with fuzzing instrumentation and runs the
+// fuzz target. Output is sent to sse as "stdout" and "stderr" events,
+// progress as "progress" (FuzzProgress) events
+func fuzzGo(ctx context.Context, body string, goVersion string, targetName string, fuzzFor time.Duration, sse *sseWriter) (*FuzzExit, error) {
+	res := &FuzzExit{Target: targetName}
+	goExe, err := localGoExe(goVersion)
+	if err != nil {
+		res.ErrorInfo = newPlayError(phaseBuild, err.Error())
+		return res, nil
+	}
+	res.GoVersion = goVersionOf(goExe)
+	files, err := splitFiles([]byte(body))
+	if err != nil {
+		res.ErrorInfo = newPlayError(phaseBuild, err.Error())
+		return res, nil
+	}
+	var target *fuzzTarget
+	for _, t := range findFuzzTargets(files) {
+		if targetName == "" || t.name == targetName {
+			target = t
+			break
+		}
+	}
+	if target == nil {
+		msg := "no fuzz target func FuzzXxx(f *testing.F)"
+		if targetName != "" {
+			msg = fmt.Sprintf("fuzz target '%s' not found", targetName)
+		}
+		res.ErrorInfo = newPlayError(phaseBuild, msg)
+		return res, nil
+	}
+	res.Target = target.name
+
+	pd, err := writeProgramDir(goExe, files)
+	if err != nil {
+		return nil, err
+	}
+	defer pd.Remove()
+	if !pd.IsTest {
+		res.ErrorInfo = newPlayError(phaseBuild, "fuzz targets can only be run in programs without main()")
+		return res, nil
+	}
+
+	fuzzRx := "^" + target.name + "$"
+	exe := filepath.Join(pd.Dir, "prog")
+	buildCtx, cancel := context.WithTimeout(ctx, goBuildTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(buildCtx, goExe, "test", "-c", "-fuzz="+fuzzRx, "-vet=off", "-trimpath", "-o", exe, ".")
+	cmd.Dir = pd.Dir
+	cmd.Env = goToolEnv()
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		res.ErrorInfo = newRunError(0, "program cancelled")
+		return res, nil
+	}
+	if buildCtx.Err() != nil {
+		res.ErrorInfo = newPlayError(phaseTimeout, "timeout building program")
+		return res, nil
+	}
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, err
+		}
+		info := newPlayError(phaseBuild, pd.cleanOutput(string(out)))
+		setEndPositions(info.Diagnostics, files)
+		res.ErrorInfo = info
+		return res, nil
+	}
+
+	// fuzzing runs in a single worker process so the usual per-process
+	// cpu and memory limits apply, except cpu time is as long as fuzzing
+	limits := getRunLimits()
+	limits.Timeout = fuzzFor + fuzzMinimizeTime + 10*time.Second
+	limits.CPU = limits.Timeout
+	// fuzz worker communicates with the coordinator via 100 MB memory-mapped file
+	limits.MaxFileSize = fuzzWorkerMemSize
+	args := []string{
+		"-test.run=^$",
+		"-test.fuzz=" + fuzzRx,
+		"-test.fuzztime=" + fuzzFor.String(),
+		"-test.fuzzminimizetime=" + fuzzMinimizeTime.String(),
+		"-test.fuzzcachedir=" + filepath.Join(pd.Dir, "fuzzcache"),
+		"-test.parallel=1",
+	}
+	lw := &fuzzLineWriter{
+		onProgress: func(p *FuzzProgress) {
+			sse.send("progress", p)
+		},
+	}
+	onEvent := func(ev *CompileEvent) {
+		sse.send(ev.Kind, ev)
+		// go test prints progress to stderr
+		if ev.Kind == "stderr" {
+			lw.write(ev.Message)
+		}
+	}
+	env := []string{fmt.Sprintf("GOMEMLIMIT=%dMiB", limits.MemoryMB)}
+	timeStart := time.Now()
+	runRes, err := runSandboxed(ctx, pd.Dir, exe, args, env, limits, onEvent)
+	res.Duration = time.Since(timeStart)
+	if err != nil {
+		return nil, err
+	}
+	runRes.setErrorInfo()
+	res.Status = runRes.Status
+	res.ErrorInfo = runRes.ErrorInfo
+
+	res.Corpus = readFailingInput(pd, target.name)
+	if res.Corpus == nil {
+		return res, nil
+	}
+	res.Crashed = true
+	var stdout strings.Builder
+	for _, ev := range runRes.Events {
+		if ev.Kind == "stdout" {
+			stdout.WriteString(ev.Message)
+		}
+	}
+	failure := stdout.String()
+	if i := strings.Index(failure, "--- FAIL"); i >= 0 {
+		failure = failure[i:]
+	}
+	res.Failure = pd.renameFiles(strings.TrimSpace(failure))
+	res.Reproducer = fuzzReproducer(target, res.Corpus)
+	return res, nil
+}
+
+// POST /api/goplay/fuzz?fuzz=${target}&time=${seconds}&go=${version}
+// fuzzes the code and sends the output as server-sent events:
+// "start" (StreamStart), "queued" (StreamQueued), "stdout" and "stderr" (CompileEvent),
+// "progress" (FuzzProgress) and "exit" (FuzzExit)
+func fuzzHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isLocalGoRunBackend() {
+		http.Error(w, "Fuzzing requires local go run backend", http.StatusNotImplemented)
+		return
+	}
+	bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, maxSnippetSize+1))
+	if err != nil {
+		http.Error(w, "Failed to read request data", http.StatusInternalServerError)
+		return
+	}
+	if len(bodyBytes) > maxSnippetSize {
+		http.Error(w, "Snippet is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	fuzzFor := fuzzTime(r.FormValue("time"))
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Now().Add(goBuildTimeout + fuzzFor + fuzzMinimizeTime + time.Minute))
+
+	sse := newSSEWriter(w)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	id := registerRunningProgram(cancel)
+	defer unregisterRunningProgram(id)
+	sse.send("start", &StreamStart{ID: id})
+
+	release, msg := waitForRunSlot(ctx, sse)
+	if release == nil {
+		sse.send("exit", &FuzzExit{ErrorInfo: newRunError(0, msg)})
+		return
+	}
+	defer release()
+
+	res, err := fuzzGo(ctx, string(bodyBytes), r.FormValue("go"), r.FormValue("fuzz"), fuzzFor, sse)
+	if err != nil {
+		logf("fuzzHandler: fuzzGo() failed with '%s'\n", err)
+		res = &FuzzExit{ErrorInfo: newRunError(0, "Failed to fuzz source code")}
+	}
+	sse.send("exit", res)
+}
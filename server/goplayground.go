@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
@@ -19,11 +18,13 @@ const userAgent = "http://tools.arslexis.io/goplayground/"
 // https://github.com/golang/playground/blob/master/app/goplay/share.go
 const maxSnippetSize = 64 * 1024
 
-// FmtResponse is the response returned from
-// upstream play.golang.org/fmt request
+// FmtResponse is the response of /api/goplay/fmt, same as
+// returned from upstream play.golang.org/fmt request
 type FmtResponse struct {
 	Body  string
 	Error string
+	// structured version of Error
+	ErrorInfo *PlayError `json:",omitempty"`
 }
 
 // CompileEvent represents individual
@@ -34,12 +35,29 @@ type CompileEvent struct {
 	Delay   time.Duration
 }
 
-// CompileResponse is the response returned from
-// upstream play.golang.org/compile request
+// CompileResponse is the response of /api/goplay/compile, same as
+// returned from upstream play.golang.org/compile request
 type CompileResponse struct {
 	Body   *string
 	Events []*CompileEvent
 	Errors string
+	// exit code of the program
+	Status int
+	// why building or running failed, structured version of Errors
+	ErrorInfo *PlayError `json:",omitempty"`
+	// true if the program had no main() and we ran tests
+	IsTest      bool
+	TestsFailed int
+	// only set by local backend
+	Tests *TestReport `json:",omitempty"`
+	// coverage of the code by tests, only set by local backend
+	Coverage *CoverageReport `json:",omitempty"`
+	// options the code was built and run with
+	Options *RunOptions `json:",omitempty"`
+	// version of Go that ran the program e.g. "go1.22.3"
+	GoVersion string `json:",omitempty"`
+	// true if this is a cached result of running the same code before
+	Cached bool `json:",omitempty"`
 }
 
 func doRequest(method, url, contentType string, body io.Reader) ([]byte, error) {
@@ -49,7 +67,7 @@ func doRequest(method, url, contentType string, body io.Reader) ([]byte, error)
 	}
 	req.Header.Add("Content-Type", contentType)
 	req.Header.Add("User-Agent", userAgent)
-	response, err := http.DefaultClient.Do(req)
+	response, err := upstreamPlayground.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -70,24 +88,20 @@ func postForm(url string, data url.Values) ([]byte, error) {
 	return doRequest("POST", url, "application/x-www-form-urlencoded", strings.NewReader(data.Encode()))
 }
 
-func runShare(body io.Reader) ([]byte, error) {
-	return doRequest("POST", "https://play.golang.org/share", "text/plain", body)
-}
-
-func runImports(body *string) ([]byte, error) {
+func runImports(body *string, backend string) ([]byte, error) {
 	form := url.Values{}
 	form.Add("imports", "true")
 	form.Add("body", *body)
 
-	return postForm("https://play.golang.org/fmt", form)
+	return postForm(upstreamURL("/fmt", backend), form)
 }
 
-func runCompile(body *string) ([]byte, error) {
+func runCompile(body *string, backend string) ([]byte, error) {
 	form := url.Values{}
 	form.Add("body", *body)
 	form.Add("version", "2")
 
-	return postForm("https://play.golang.org/compile", form)
+	return postForm(upstreamURL("/compile", backend), form)
 }
 
 // format code snippet
@@ -103,11 +117,19 @@ func fmtHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body := string(bodyBytes)
-	bodyBytes, err = runImports(&body)
+	fmtResponse, err := formatGo(string(bodyBytes), r.FormValue("go"))
+	if err != nil {
+		log.Printf("formatGo() error: %v", err)
+		serveUpstreamError(w, err, "Failed to format source code")
+		return
+	}
+	if !wantsLegacyErrors(r) {
+		fmtResponse.Error = ""
+	}
+	bodyBytes, err = json.Marshal(fmtResponse)
 	if err != nil {
-		log.Printf("runImports() error: %v", err)
-		http.Error(w, "Failed to format source code", http.StatusInternalServerError)
+		log.Printf("fmtResponse marshal error: %v", err)
+		http.Error(w, "Failed to encode data", http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -121,62 +143,68 @@ func compileHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-
-	bodyBytes, err := io.ReadAll(r.Body)
+	opts, err := parseRunOptions(r)
 	if err != nil {
-		http.Error(w, "Failed to read request data", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	body := string(bodyBytes)
-
-	bodyBytes, err = runImports(&body)
+	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("runImports() error: %v", err)
-		http.Error(w, "Failed to format source code", http.StatusInternalServerError)
+		http.Error(w, "Failed to read request data", http.StatusInternalServerError)
 		return
 	}
 
-	fmtResponse := FmtResponse{}
+	body := string(bodyBytes)
 
-	err = json.Unmarshal(bodyBytes, &fmtResponse)
+	fmtResponse, err := formatGo(body, r.FormValue("go"))
 	if err != nil {
-		log.Printf("fmtResponse unmarshal error: %v", err)
-		http.Error(w, "Failed to decode upstream server response", http.StatusInternalServerError)
+		log.Printf("formatGo() error: %v", err)
+		serveUpstreamError(w, err, "Failed to format source code")
 		return
 	}
 
 	if fmtResponse.Error != "" {
+		if !wantsLegacyErrors(r) {
+			fmtResponse.Error = ""
+		}
+		bodyBytes, err = json.Marshal(fmtResponse)
+		if err != nil {
+			log.Printf("fmtResponse marshal error: %v", err)
+			http.Error(w, "Failed to encode data", http.StatusInternalServerError)
+			return
+		}
 		w.Write(bodyBytes)
 		return
 	}
 
 	bodyUpdated := fmtResponse.Body != body
 
-	bodyBytes, err = runCompile(&fmtResponse.Body)
-	if err != nil {
-		log.Printf("runCompile() error: %v", err)
-		http.Error(w, "Failed to compile source code", http.StatusInternalServerError)
+	release := acquireRunSlot(w, r)
+	if release == nil {
 		return
 	}
-
-	if !bodyUpdated {
-		w.Write(bodyBytes)
-		return
+	defer release()
+	req := &runRequest{
+		Body:      fmtResponse.Body,
+		GoVersion: r.FormValue("go"),
+		Options:   opts,
 	}
-
-	// return a new payload with the formatted body
-
-	compileResponse := CompileResponse{}
-
-	err = json.Unmarshal(bodyBytes, &compileResponse)
+	compileResponse, err := getGoRunner().Run(r.Context(), req, nil)
 	if err != nil {
-		log.Printf("compileResponse unmarshal error: %v", err)
-		http.Error(w, "Failed to decode upstream server response", http.StatusInternalServerError)
+		log.Printf("goRunner.Run() error: %v", err)
+		serveUpstreamError(w, err, "Failed to compile source code")
 		return
 	}
+	compileResponse.Options = opts
 
-	compileResponse.Body = &fmtResponse.Body
+	// return the formatted body so that the editor can update the block
+	if bodyUpdated {
+		compileResponse.Body = &fmtResponse.Body
+	}
+	if !wantsLegacyErrors(r) {
+		compileResponse.Errors = ""
+	}
 
 	bodyBytes, err = json.Marshal(compileResponse)
 	if err != nil {
@@ -196,13 +224,34 @@ func shareHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	bodyBytes, err := runShare(r.Body)
+	bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, maxSnippetSize+1))
+	if err != nil {
+		http.Error(w, "Failed to read request data", http.StatusInternalServerError)
+		return
+	}
+	if len(bodyBytes) > maxSnippetSize {
+		http.Error(w, "Snippet is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// multi-file snippets must be valid txtar archives
+	if _, err = splitFiles(bodyBytes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := shareSnippet(bodyBytes)
+	if errors.Is(err, errSnippetsFull) {
+		http.Error(w, "Snippet storage is full", http.StatusInsufficientStorage)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to send share request", http.StatusInternalServerError)
+		log.Printf("shareSnippet() error: %v", err)
+		http.Error(w, "Failed to save snippet", http.StatusInternalServerError)
 		return
 	}
 
-	w.Write(bodyBytes)
+	w.Write([]byte(id))
 }
 
 // given the hash of the content get the content
@@ -214,23 +263,24 @@ func loadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response, err := http.Get("https://play.golang.org/p/" + r.URL.RawQuery + ".go")
-	if err != nil {
-		http.Error(w, "Failed to load snippet", http.StatusInternalServerError)
+	id := r.URL.RawQuery
+	if !isValidSnippetID(id) {
+		http.Error(w, "Invalid snippet id", http.StatusBadRequest)
 		return
 	}
-	defer response.Body.Close()
 
-	bodyBytes, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		http.Error(w, "Failed to read data", http.StatusInternalServerError)
+	bodyBytes, err := loadSnippet(id)
+	if errors.Is(err, errSnippetNotFound) {
+		http.Error(w, "Snippet not found", http.StatusNotFound)
+		return
 	}
-
-	if response.StatusCode != http.StatusOK {
-		http.Error(w, string(bodyBytes), response.StatusCode)
+	if err != nil {
+		log.Printf("loadSnippet() error: %v", err)
+		serveUpstreamError(w, err, "Failed to load snippet")
 		return
 	}
 
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Write(bodyBytes)
 }
 
@@ -242,6 +292,13 @@ func handleGoPlayground(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	switch call {
+	case "compile", "fmt", "stream", "check", "asm", "wasm", "fuzz", "share", "load":
+		// those are expensive, either call upstream, use local cpu or disk
+		if !checkGoPlayRateLimit(w, r) {
+			return
+		}
+	}
+	switch call {
 	case "compile":
 		compileHandler(w, r)
 		return
@@ -254,7 +311,38 @@ func handleGoPlayground(w http.ResponseWriter, r *http.Request) {
 	case "fmt":
 		fmtHandler(w, r)
 		return
+	case "stream":
+		streamHandler(w, r)
+		return
+	case "cancel":
+		cancelHandler(w, r)
+		return
+	case "versions":
+		versionsHandler(w, r)
+		return
+	case "check":
+		checkHandler(w, r)
+		return
+	case "asm":
+		asmHandler(w, r)
+		return
+	case "fuzz":
+		fuzzHandler(w, r)
+		return
+	case "wasm":
+		wasmHandler(w, r)
+		return
+	case "wasm_exec.js":
+		wasmExecHandler(w, r)
+		return
+	case "cache/purge":
+		purgeCacheHandler(w, r)
+		return
 	}
 
+	if name, ok := strings.CutPrefix(call, "wasm/"); ok {
+		wasmFileHandler(w, r, name)
+		return
+	}
 	http.NotFound(w, r)
 }
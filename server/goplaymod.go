@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// Snippets can import third-party modules if config.GoProxy is set.
+// Missing requirements are resolved by go mod tidy which runs outside of
+// the sandbox so the program itself still has no network access.
+// Downloaded modules are kept in a module cache in data dir shared by all
+// snippets. When it grows over the limit, least recently used module
+// versions are moved to a trash dir and deleted from there
+
+const (
+	// default max size of the module cache
+	goModCacheMaxSizeDefault = 1024 * 1024 * 1024
+	// modules used more recently than this are not evicted because
+	// a program might still be building with them
+	goModEvictGracePeriod = 10 * time.Minute
+)
+
+var (
+	// resolving modules holds a read lock so that we don't delete modules
+	// while they're being downloaded. Eviction holds a write lock only
+	// while moving evicted modules to trash
+	muGoModCache sync.RWMutex
+
+	muGoModCacheEvict   sync.Mutex
+	goModCacheLastEvict time.Time
+	goModCacheEvicting  bool
+)
+
+func isGoProxyEnabled() bool {
+	return config.GoProxy != ""
+}
+
+// goProxyURL returns value of GOPROXY. Absolute path of a directory with
+// modules in GOPROXY layout is the same as file:// url
+func goProxyURL() string {
+	proxy := config.GoProxy
+	if filepath.IsAbs(proxy) {
+		return "file://" + filepath.ToSlash(proxy)
+	}
+	return proxy
+}
+
+func getGoModCacheDir() string {
+	// go requires absolute path
+	dir, err := filepath.Abs(filepath.Join(getDataDirMust(), "goplay-modcache"))
+	must(err)
+	return dir
+}
+
+func goModCacheMaxSize() int64 {
+	if config.GoModCacheMB > 0 {
+		return int64(config.GoModCacheMB) * 1024 * 1024
+	}
+	return goModCacheMaxSizeDefault
+}
+
+// goModEnv returns overrides of goToolEnv() for using the module cache.
+// GOPROXY stays "off" so that only resolveModules downloads modules
+func goModEnv() map[string]string {
+	if !isGoProxyEnabled() {
+		return nil
+	}
+	sumDB := config.GoSumDB
+	if sumDB == "" {
+		sumDB = "off"
+	}
+	return map[string]string{
+		"GOSUMDB":    sumDB,
+		"GOMODCACHE": getGoModCacheDir(),
+	}
+}
+
+// resolveModules adds missing requirements to go.mod and downloads them.
+// Building the program afterwards doesn't need the lock because resolved
+// modules are marked as recently used and eviction skips them
+func (pd *programDir) resolveModules(goExe string) {
+	muGoModCache.RLock()
+	defer muGoModCache.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), goBuildTimeout)
+	defer cancel()
+	// -e because errors are better reported by the build
+	cmd := exec.CommandContext(ctx, goExe, "mod", "tidy", "-e")
+	cmd.Dir = pd.Dir
+	// -mod=mod adds missing requirements to go.mod
+	cmd.Env = append(goToolEnv(), "GOPROXY="+goProxyURL(), "GOFLAGS=-mod=mod")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		logf("resolveModules: go mod tidy failed with '%s', output: '%s'\n", err, truncData(out, 256))
+	}
+	touchGoModules(pd.usedModules())
+}
+
+// usedModules returns module versions listed in go.sum of the program
+func (pd *programDir) usedModules() []module.Version {
+	d, err := os.ReadFile(filepath.Join(pd.Dir, "go.sum"))
+	if err != nil {
+		return nil
+	}
+	var res []module.Version
+	sc := bufio.NewScanner(bytes.NewReader(d))
+	for sc.Scan() {
+		// "golang.org/x/mod v0.17.0 h1:..." or "golang.org/x/mod v0.17.0/go.mod h1:..."
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		mv := module.Version{Path: fields[0], Version: strings.TrimSuffix(fields[1], "/go.mod")}
+		if !slices.Contains(res, mv) {
+			res = append(res, mv)
+		}
+	}
+	return res
+}
+
+// goModDownloadFiles returns files of a module version in cache/download
+// e.g. v1.0.0.info, v1.0.0.mod, v1.0.0.zip
+func goModDownloadFiles(cacheDir string, mv module.Version) []string {
+	escPath, err1 := module.EscapePath(mv.Path)
+	escVer, err2 := module.EscapeVersion(mv.Version)
+	if err1 != nil || err2 != nil {
+		return nil
+	}
+	dir := filepath.Join(cacheDir, "cache", "download", filepath.FromSlash(escPath), "@v")
+	files, _ := filepath.Glob(filepath.Join(dir, escVer+".*"))
+	return files
+}
+
+// touchGoModules marks modules as recently used
+func touchGoModules(mods []module.Version) {
+	cacheDir := getGoModCacheDir()
+	now := time.Now()
+	for _, mv := range mods {
+		for _, path := range goModDownloadFiles(cacheDir, mv) {
+			_ = os.Chtimes(path, now, now)
+		}
+	}
+}
+
+// cachedGoModule is a module version in the module cache
+type cachedGoModule struct {
+	mv       module.Version
+	size     int64
+	lastUsed time.Time
+}
+
+func dirSize(dir string) int64 {
+	var res int64
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			res += fi.Size()
+		}
+		return nil
+	})
+	return res
+}
+
+// listCachedGoModules returns all module versions in the module cache
+func listCachedGoModules(cacheDir string) []*cachedGoModule {
+	var res []*cachedGoModule
+	downloadDir := filepath.Join(cacheDir, "cache", "download")
+	_ = filepath.WalkDir(downloadDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".mod") {
+			return nil
+		}
+		// ${escaped module path}/@v/${escaped version}.mod
+		dir, name := filepath.Dir(path), filepath.Base(path)
+		if filepath.Base(dir) != "@v" {
+			return nil
+		}
+		escPath, err := filepath.Rel(downloadDir, filepath.Dir(dir))
+		if err != nil {
+			return nil
+		}
+		modPath, err1 := module.UnescapePath(filepath.ToSlash(escPath))
+		version, err2 := module.UnescapeVersion(strings.TrimSuffix(name, ".mod"))
+		if err1 != nil || err2 != nil {
+			return nil
+		}
+		m := &cachedGoModule{mv: module.Version{Path: modPath, Version: version}}
+		for _, path := range goModDownloadFiles(cacheDir, m.mv) {
+			if fi, err := os.Stat(path); err == nil {
+				m.size += fi.Size()
+				if fi.ModTime().After(m.lastUsed) {
+					m.lastUsed = fi.ModTime()
+				}
+			}
+		}
+		m.size += dirSize(goModSourceDir(cacheDir, m.mv))
+		res = append(res, m)
+		return nil
+	})
+	return res
+}
+
+// goModSourceDir returns directory with extracted source code of a module
+func goModSourceDir(cacheDir string, mv module.Version) string {
+	escPath, err1 := module.EscapePath(mv.Path)
+	escVer, err2 := module.EscapeVersion(mv.Version)
+	if err1 != nil || err2 != nil {
+		return ""
+	}
+	return filepath.Join(cacheDir, filepath.FromSlash(escPath)+"@"+escVer)
+}
+
+// makeWritable undoes go making extracted source code read-only,
+// which prevents moving and deleting it
+func makeWritable(dir string) {
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			_ = os.Chmod(path, 0755)
+		}
+		return nil
+	})
+}
+
+// trashGoModule moves files of a module version from the cache to trashDir.
+// It's fast so that we hold the write lock only for a short time
+func trashGoModule(cacheDir string, trashDir string, mv module.Version) error {
+	dst, err := os.MkdirTemp(trashDir, "mod-")
+	if err != nil {
+		return err
+	}
+	if dir := goModSourceDir(cacheDir, mv); dir != "" {
+		if _, err := os.Stat(dir); err == nil {
+			// moving a directory to a different parent requires write
+			// permission to update its ".." entry
+			_ = os.Chmod(dir, 0755)
+			err = os.Rename(dir, filepath.Join(dst, "src"))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, path := range goModDownloadFiles(cacheDir, mv) {
+		err = os.Rename(path, filepath.Join(dst, filepath.Base(path)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emptyTrash deletes modules moved to trashDir
+func emptyTrash(trashDir string) {
+	makeWritable(trashDir)
+	err := os.RemoveAll(trashDir)
+	if err != nil {
+		logf("emptyTrash: os.RemoveAll('%s') failed with '%s'\n", trashDir, err)
+	}
+}
+
+// evictGoModCache deletes least recently used module versions until
+// the size of the cache is below maxSize. Listing modules is done without
+// the lock so that programs can resolve modules at the same time
+func evictGoModCache(cacheDir string, maxSize int64) {
+	mods := listCachedGoModules(cacheDir)
+	var total int64
+	for _, m := range mods {
+		total += m.size
+	}
+	if total <= maxSize {
+		return
+	}
+	slices.SortFunc(mods, func(a, b *cachedGoModule) int {
+		return a.lastUsed.Compare(b.lastUsed)
+	})
+	var evict []*cachedGoModule
+	for _, m := range mods {
+		if total <= maxSize || time.Since(m.lastUsed) < goModEvictGracePeriod {
+			break
+		}
+		evict = append(evict, m)
+		total -= m.size
+	}
+	if len(evict) == 0 {
+		return
+	}
+
+	// must be on the same file system as cacheDir so that moving is fast
+	trashDir := cacheDir + "-trash"
+	err := os.MkdirAll(trashDir, 0755)
+	if err != nil {
+		logf("evictGoModCache: os.MkdirAll('%s') failed with '%s'\n", trashDir, err)
+		return
+	}
+	muGoModCache.Lock()
+	for _, m := range evict {
+		err = trashGoModule(cacheDir, trashDir, m.mv)
+		if err != nil {
+			logf("evictGoModCache: trashGoModule('%s') failed with '%s'\n", m.mv, err)
+			break
+		}
+		logf("evictGoModCache: removed '%s'\n", m.mv)
+	}
+	muGoModCache.Unlock()
+	emptyTrash(trashDir)
+}
+
+// maybeEvictGoModCache starts eviction in the background, at most once a minute
+func maybeEvictGoModCache() {
+	if !isGoProxyEnabled() {
+		return
+	}
+	muGoModCacheEvict.Lock()
+	defer muGoModCacheEvict.Unlock()
+	if goModCacheEvicting || time.Since(goModCacheLastEvict) < time.Minute {
+		return
+	}
+	goModCacheEvicting = true
+	go func() {
+		evictGoModCache(getGoModCacheDir(), goModCacheMaxSize())
+		muGoModCacheEvict.Lock()
+		goModCacheEvicting = false
+		goModCacheLastEvict = time.Now()
+		muGoModCacheEvict.Unlock()
+	}()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RunOptions changes how Go code is built and run. Sent as JSON in
+// options= form value of /api/goplay/compile and /api/goplay/stream
+// and echoed back in the response
+type RunOptions struct {
+	// build and run with -race
+	Race bool `json:",omitempty"`
+	// build tags, passed as -tags
+	Tags []string `json:",omitempty"`
+	// environment variables for building and running, only
+	// those in runOptionsEnv are allowed
+	Env map[string]string `json:",omitempty"`
+	// if set, the code is only compiled for this platform to check
+	// that it builds, it's not run
+	GOOS   string `json:",omitempty"`
+	GOARCH string `json:",omitempty"`
+}
+
+// environment variables that can be set with RunOptions.Env
+var runOptionsEnv = []string{
+	"GODEBUG",
+	"GOEXPERIMENT",
+	"GOGC",
+	"GOMAXPROCS",
+	"GOTRACEBACK",
+}
+
+// platforms we can build for in build only mode, from go tool dist list
+var (
+	knownGOOS = []string{
+		"aix", "android", "darwin", "dragonfly", "freebsd", "illumos", "ios", "js",
+		"linux", "netbsd", "openbsd", "plan9", "solaris", "wasip1", "windows",
+	}
+	knownGOARCH = []string{
+		"386", "amd64", "arm", "arm64", "loong64", "mips", "mips64", "mips64le",
+		"mipsle", "ppc64", "ppc64le", "riscv64", "s390x", "wasm",
+	}
+)
+
+const (
+	maxRunOptionsTags  = 16
+	maxRunOptionsValue = 256
+)
+
+var rxBuildTag = regexp.MustCompile(`^[a-zA-Z0-9_.]+$`)
+
+// isBuildOnly returns true if the code should only be compiled
+func (o *RunOptions) isBuildOnly() bool {
+	return o != nil && (o.GOOS != "" || o.GOARCH != "")
+}
+
+// isEmpty returns true if o doesn't change how the code is built and run
+func (o *RunOptions) isEmpty() bool {
+	return o == nil || (!o.Race && len(o.Tags) == 0 && len(o.Env) == 0 && !o.isBuildOnly())
+}
+
+// validate checks the options and fills in defaults
+func (o *RunOptions) validate() error {
+	if len(o.Tags) > maxRunOptionsTags {
+		return fmt.Errorf("too many build tags, max is %d", maxRunOptionsTags)
+	}
+	for _, tag := range o.Tags {
+		if !rxBuildTag.MatchString(tag) {
+			return fmt.Errorf("invalid build tag %s", strconv.Quote(tag))
+		}
+	}
+	for k, v := range o.Env {
+		if !slices.Contains(runOptionsEnv, k) {
+			return fmt.Errorf("environment variable %s is not allowed, must be one of: %s", k, strings.Join(runOptionsEnv, ", "))
+		}
+		if len(v) > maxRunOptionsValue || strings.ContainsAny(v, "\x00\r\n") {
+			return fmt.Errorf("invalid value of %s", k)
+		}
+	}
+	if o.isBuildOnly() {
+		if o.GOOS == "" {
+			o.GOOS = "linux"
+		}
+		if o.GOARCH == "" {
+			o.GOARCH = "amd64"
+		}
+		if !slices.Contains(knownGOOS, o.GOOS) {
+			return fmt.Errorf("unsupported GOOS %s", strconv.Quote(o.GOOS))
+		}
+		if !slices.Contains(knownGOARCH, o.GOARCH) {
+			return fmt.Errorf("unsupported GOARCH %s", strconv.Quote(o.GOARCH))
+		}
+		if o.Race {
+			return fmt.Errorf("race detector can't be used when only building the code")
+		}
+	}
+	// same options in different order should have the same cache key
+	sort.Strings(o.Tags)
+	o.Tags = slices.Compact(o.Tags)
+	return nil
+}
+
+// parseRunOptions returns nil if the request doesn't have options
+func parseRunOptions(r *http.Request) (*RunOptions, error) {
+	s := r.FormValue("options")
+	if s == "" {
+		return nil, nil
+	}
+	var o RunOptions
+	err := json.Unmarshal([]byte(s), &o)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options: %w", err)
+	}
+	err = o.validate()
+	if err != nil {
+		return nil, err
+	}
+	if o.isEmpty() {
+		return nil, nil
+	}
+	return &o, nil
+}
+
+// buildArgs returns flags for go build or go test -c
+func (o *RunOptions) buildArgs() []string {
+	if o == nil {
+		return nil
+	}
+	var res []string
+	if o.Race {
+		res = append(res, "-race")
+	}
+	if len(o.Tags) > 0 {
+		res = append(res, "-tags="+strings.Join(o.Tags, ","))
+	}
+	return res
+}
+
+// buildEnv returns environment variables to add to goToolEnv()
+func (o *RunOptions) buildEnv() []string {
+	if o == nil {
+		return nil
+	}
+	res := o.runEnv()
+	// the race detector needs cgo
+	if o.Race {
+		res = append(res, "CGO_ENABLED=1")
+	}
+	if o.isBuildOnly() {
+		res = append(res, "GOOS="+o.GOOS, "GOARCH="+o.GOARCH)
+	}
+	return res
+}
+
+// runEnv returns environment variables for running the program
+func (o *RunOptions) runEnv() []string {
+	if o == nil {
+		return nil
+	}
+	var res []string
+	for _, k := range runOptionsEnv {
+		if v, ok := o.Env[k]; ok {
+			res = append(res, k+"="+v)
+		}
+	}
+	// by default programs built with -race sleep 1s before exiting
+	if o.Race {
+		res = append(res, "GORACE=atexit_sleep_ms=0")
+	}
+	return res
+}
+
+// usesCgo returns true if any file imports "C". We only enable cgo for
+// the race detector and don't want to compile C code from the snippet
+func usesCgo(files *programFiles) bool {
+	for _, name := range files.names {
+		if !strings.HasSuffix(name, ".go") {
+			continue
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), name, files.data[name], parser.ImportsOnly)
+		if err != nil {
+			continue
+		}
+		for _, imp := range f.Imports {
+			if imp.Path.Value == `"C"` {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRunOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+		want    *RunOptions
+		wantErr string
+	}{
+		{
+			name: "no options",
+		},
+		{
+			name:    "empty options",
+			options: `{}`,
+		},
+		{
+			name:    "race",
+			options: `{"Race": true}`,
+			want:    &RunOptions{Race: true},
+		},
+		{
+			name:    "tags are sorted and de-duplicated",
+			options: `{"Tags": ["b", "a", "b"]}`,
+			want:    &RunOptions{Tags: []string{"a", "b"}},
+		},
+		{
+			name:    "env",
+			options: `{"Env": {"GOMAXPROCS": "2", "GODEBUG": "panicnil=1"}}`,
+			want:    &RunOptions{Env: map[string]string{"GOMAXPROCS": "2", "GODEBUG": "panicnil=1"}},
+		},
+		{
+			name:    "build only defaults",
+			options: `{"GOOS": "windows"}`,
+			want:    &RunOptions{GOOS: "windows", GOARCH: "amd64"},
+		},
+		{
+			name:    "build only for arch",
+			options: `{"GOARCH": "arm64"}`,
+			want:    &RunOptions{GOOS: "linux", GOARCH: "arm64"},
+		},
+		{
+			name:    "invalid json",
+			options: `{"Race": 1}`,
+			wantErr: "invalid options",
+		},
+		{
+			name:    "invalid tag",
+			options: `{"Tags": ["a b"]}`,
+			wantErr: "invalid build tag",
+		},
+		{
+			name:    "too many tags",
+			options: `{"Tags": ["a","b","c","d","e","f","g","h","i","j","k","l","m","n","o","p","q"]}`,
+			wantErr: "too many build tags",
+		},
+		{
+			name:    "env not allowed",
+			options: `{"Env": {"PATH": "/tmp"}}`,
+			wantErr: "PATH is not allowed",
+		},
+		{
+			name:    "env value with newline",
+			options: `{"Env": {"GOGC": "1\nX=2"}}`,
+			wantErr: "invalid value of GOGC",
+		},
+		{
+			name:    "unknown GOOS",
+			options: `{"GOOS": "beos"}`,
+			wantErr: "unsupported GOOS",
+		},
+		{
+			name:    "unknown GOARCH",
+			options: `{"GOARCH": "z80"}`,
+			wantErr: "unsupported GOARCH",
+		},
+		{
+			name:    "race when only building",
+			options: `{"Race": true, "GOOS": "linux"}`,
+			wantErr: "race detector",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			if tt.options != "" {
+				form.Set("options", tt.options)
+			}
+			r := httptest.NewRequest("POST", "/api/goplay/compile?"+form.Encode(), nil)
+			got, err := parseRunOptions(r)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunOptionsArgsAndEnv(t *testing.T) {
+	var none *RunOptions
+	if none.buildArgs() != nil || none.buildEnv() != nil || none.runEnv() != nil {
+		t.Errorf("nil options must not add args or env")
+	}
+	o := &RunOptions{Race: true, Tags: []string{"a", "b"}, Env: map[string]string{"GOGC": "50"}}
+	if got, want := o.buildArgs(), []string{"-race", "-tags=a,b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("buildArgs() got %v, want %v", got, want)
+	}
+	env := strings.Join(o.buildEnv(), " ")
+	for _, want := range []string{"GOGC=50", "CGO_ENABLED=1"} {
+		if !strings.Contains(env, want) {
+			t.Errorf("buildEnv() %q doesn't have %s", env, want)
+		}
+	}
+	env = strings.Join(o.runEnv(), " ")
+	for _, want := range []string{"GOGC=50", "GORACE="} {
+		if !strings.Contains(env, want) {
+			t.Errorf("runEnv() %q doesn't have %s", env, want)
+		}
+	}
+}
@@ -0,0 +1,632 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// goRunner builds and runs Go programs. Results are in the same
+// shape as play.golang.org/compile so that the frontend doesn't
+// care where the code was run.
+// If onEvent is not nil, it's called with the output as it's produced.
+// Cancelling ctx kills the program
+type goRunner interface {
+	Run(ctx context.Context, req *runRequest, onEvent func(*CompileEvent)) (*CompileResponse, error)
+}
+
+// runRequest describes what to run and how
+type runRequest struct {
+	// formatted source code
+	Body string
+	// e.g. "go1.22" or "gotip", empty for default version
+	GoVersion string
+	// nil if the code is built and run with defaults
+	Options *RunOptions `json:",omitempty"`
+}
+
+// runs the code on play.golang.org
+type upstreamGoRunner struct{}
+
+// upstream doesn't stream so we send all events after the program finished
+func (upstreamGoRunner) Run(ctx context.Context, req *runRequest, onEvent func(*CompileEvent)) (*CompileResponse, error) {
+	if !req.Options.isEmpty() {
+		msg := "run options are only supported when running code locally"
+		return &CompileResponse{Errors: msg, ErrorInfo: newPlayError(phaseBuild, msg)}, nil
+	}
+	backend, err := upstreamBackendForVersion(req.GoVersion)
+	if err != nil {
+		msg := err.Error()
+		return &CompileResponse{Errors: msg, ErrorInfo: newPlayError(phaseBuild, msg)}, nil
+	}
+	d, err := runCompile(&req.Body, backend)
+	if err != nil {
+		return nil, err
+	}
+	res := &CompileResponse{}
+	err = json.Unmarshal(d, res)
+	if err != nil {
+		return nil, err
+	}
+	res.GoVersion = upstreamGoVersion(backend)
+	res.setErrorInfo()
+	if onEvent != nil {
+		for _, ev := range res.Events {
+			onEvent(ev)
+		}
+	}
+	return res, nil
+}
+
+// builds and runs the code with local go toolchain, in a temporary
+// directory, with limits on time, cpu, memory and size of the output
+// and, where supported, without network access
+type localGoRunner struct {
+	limits *runLimits
+}
+
+// building is not limited by runLimits.Timeout because it can take a long time
+// when the build cache is cold
+const goBuildTimeout = time.Minute
+
+type runLimits struct {
+	Timeout   time.Duration
+	CPU       time.Duration
+	MemoryMB  int
+	MaxOutput int
+	// max size of files the program can write, 0 means 2 * MaxOutput
+	MaxFileSize int
+}
+
+func getRunLimits() *runLimits {
+	orDefault := func(v int, def int) int {
+		if v > 0 {
+			return v
+		}
+		return def
+	}
+	return &runLimits{
+		Timeout:   time.Duration(orDefault(config.GoRunTimeoutSec, 10)) * time.Second,
+		CPU:       time.Duration(orDefault(config.GoRunCPUSec, 5)) * time.Second,
+		MemoryMB:  orDefault(config.GoRunMemoryMB, 512),
+		MaxOutput: orDefault(config.GoRunMaxOutputKB, 1024) * 1024,
+	}
+}
+
+func isLocalGoRunBackend() bool {
+	return config.GoRunBackend == "local"
+}
+
+func getGoRunner() goRunner {
+	var r goRunner
+	backend := config.GoRunBackend
+	switch backend {
+	case "", "upstream":
+		backend = "upstream"
+		r = upstreamGoRunner{}
+	case "local":
+		r = &localGoRunner{limits: getRunLimits()}
+	default:
+		panicIf(true, "unknown go run backend '%s'", config.GoRunBackend)
+	}
+	if cache := getGoRunCache(); cache != nil {
+		r = &cachingGoRunner{r: r, cache: cache, backend: backend}
+	}
+	return r
+}
+
+// call at startup to catch mis-configuration early
+func validateGoRunBackend() {
+	getGoRunner()
+	if !isLocalGoRunBackend() {
+		logf("validateGoRunBackend: running Go code on play.golang.org\n")
+		return
+	}
+	_, err := exec.LookPath("go")
+	panicIf(err != nil, "go run backend is 'local' but go toolchain is not installed")
+	logf("validateGoRunBackend: running Go code locally with %s, limits: %+v\n", goVersionOf("go"), getRunLimits())
+	for name := range config.GoToolchains {
+		goExe, _ := localGoExe(name)
+		v := goVersionOf(goExe)
+		panicIf(v == "", "go toolchain '%s' at '%s' doesn't work", name, goExe)
+		logf("validateGoRunBackend: toolchain '%s' is %s\n", name, v)
+	}
+	if isGoProxyEnabled() {
+		logf("validateGoRunBackend: resolving modules with GOPROXY=%s, module cache: '%s'\n", goProxyURL(), getGoModCacheDir())
+	}
+	err = checkSandbox()
+	panicIf(err != nil, "sandbox for running programs doesn't work: '%s'. On Linux it needs unprivileged user namespaces, see sysctl kernel.unprivileged_userns_clone and user.max_user_namespaces", err)
+	if !sandboxIsolatesNetwork {
+		logf("validateGoRunBackend: warning: programs will have network access on this platform\n")
+	}
+}
+
+func goModContent(goExe string) string {
+	s := "module play\n"
+	// go directive decides language version e.g. availability of generics
+	if v, ok := strings.CutPrefix(goVersionOf(goExe), "go"); ok {
+		// "1.23rc1" is not a valid go directive
+		v, _, _ = strings.Cut(v, "rc")
+		v, _, _ = strings.Cut(v, "beta")
+		s += "\ngo " + v + "\n"
+	}
+	return s
+}
+
+// environment for invoking go tool. We don't want settings of the server
+// process (e.g. GOFLAGS, GOOS) to leak into building the snippets
+func goToolEnv() []string {
+	overrides := map[string]string{
+		"GOFLAGS":     "",
+		"GOWORK":      "off",
+		"GOTOOLCHAIN": "local",
+		"GOPROXY":     "off",
+		"CGO_ENABLED": "0",
+		"GOOS":        "",
+		"GOARCH":      "",
+	}
+	for k, v := range goModEnv() {
+		overrides[k] = v
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		if _, ok := overrides[k]; ok {
+			continue
+		}
+		env = append(env, kv)
+	}
+	for k, v := range overrides {
+		if v != "" {
+			env = append(env, k+"="+v)
+		}
+	}
+	return env
+}
+
+// checkSandbox runs a trivial command in the sandbox. It fails e.g.
+// on hosts where unprivileged user namespaces are disabled
+func checkSandbox() error {
+	exe, err := exec.LookPath("true")
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "edna-sandbox-check-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cmd := sandboxCommand(ctx, dir, exe, nil, getRunLimits())
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return e("%s, output: '%s'", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// programDir is a temporary directory with a go module containing the program
+type programDir struct {
+	Dir   string
+	Files *programFiles
+	// true for programs that should be run like go test
+	IsTest bool
+	// name on disk => name in the snippet, for files we had to rename
+	renamed map[string]string
+}
+
+// writeProgramDir creates a temporary directory with a go module
+// containing the program. Caller must call Remove()
+func writeProgramDir(goExe string, files *programFiles) (*programDir, error) {
+	dir, err := os.MkdirTemp("", "edna-goplay-")
+	if err != nil {
+		return nil, err
+	}
+	pd := &programDir{
+		Dir:     dir,
+		Files:   files,
+		renamed: map[string]string{},
+	}
+	err = pd.write(goExe)
+	if err != nil {
+		pd.Remove()
+		return nil, err
+	}
+	if isGoProxyEnabled() {
+		pd.resolveModules(goExe)
+	}
+	return pd, nil
+}
+
+func (pd *programDir) write(goExe string) error {
+	files := pd.Files
+	// programs without main() but with tests are run like go test
+	pd.IsTest = isTestProgram(files)
+	for _, name := range files.names {
+		diskName := name
+		// tests must be in _test.go files
+		if pd.IsTest && name == progName {
+			diskName = testProgName
+			pd.renamed[diskName] = name
+		}
+		path := filepath.Join(pd.Dir, filepath.FromSlash(diskName))
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(path, files.data[name], 0644)
+		if err != nil {
+			return err
+		}
+	}
+	if _, ok := files.data["go.mod"]; ok {
+		return nil
+	}
+	return os.WriteFile(filepath.Join(pd.Dir, "go.mod"), []byte(goModContent(goExe)), 0644)
+}
+
+func (pd *programDir) Remove() {
+	if isGoProxyEnabled() {
+		touchGoModules(pd.usedModules())
+	}
+	os.RemoveAll(pd.Dir)
+	maybeEvictGoModCache()
+}
+
+// fileName returns name of the file in the snippet given a path in the output
+// of go tools e.g. "./prog_test.go" => "prog.go"
+func (pd *programDir) fileName(path string) string {
+	path = strings.TrimPrefix(path, pd.Dir+string(filepath.Separator))
+	path = filepath.ToSlash(path)
+	path = strings.TrimPrefix(path, "./")
+	if name, ok := pd.renamed[path]; ok {
+		return name
+	}
+	return path
+}
+
+// rxFilePos matches "./prog.go:5:2" in go build output
+var rxFilePos = regexp.MustCompile(`(^|\s)(\S+\.go):(\d+)`)
+
+// cleanOutput makes the output of go tools not depend on the temporary
+// directory and refer to file names in the snippet
+func (pd *programDir) cleanOutput(out string) string {
+	var lines []string
+	for _, line := range strings.Split(out, "\n") {
+		// "# play" header before the errors
+		if strings.HasPrefix(line, "# ") {
+			continue
+		}
+		lines = append(lines, pd.renameFiles(line))
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// renameFiles replaces file paths in s with names of files in the snippet
+func (pd *programDir) renameFiles(s string) string {
+	return rxFilePos.ReplaceAllStringFunc(s, func(s string) string {
+		m := rxFilePos.FindStringSubmatch(s)
+		return m[1] + pd.fileName(m[2]) + ":" + m[3]
+	})
+}
+
+func (r *localGoRunner) Run(ctx context.Context, req *runRequest, onEvent func(*CompileEvent)) (*CompileResponse, error) {
+	res, err := r.run(ctx, req, onEvent)
+	if err != nil {
+		return nil, err
+	}
+	res.setErrorInfo()
+	return res, nil
+}
+
+func (r *localGoRunner) run(ctx context.Context, req *runRequest, onEvent func(*CompileEvent)) (*CompileResponse, error) {
+	goExe, err := localGoExe(req.GoVersion)
+	if err != nil {
+		return &CompileResponse{Errors: err.Error()}, nil
+	}
+	files, err := splitFiles([]byte(req.Body))
+	if err != nil {
+		return &CompileResponse{Errors: err.Error()}, nil
+	}
+	opts := req.Options
+	if opts != nil && opts.Race && usesCgo(files) {
+		return &CompileResponse{Errors: "cgo can't be used with the race detector"}, nil
+	}
+	pd, err := writeProgramDir(goExe, files)
+	if err != nil {
+		return nil, err
+	}
+	defer pd.Remove()
+	dir, isTest := pd.Dir, pd.IsTest
+
+	exe := filepath.Join(dir, "prog")
+	build := func(buildArgs ...string) ([]byte, error) {
+		buildCtx, cancel := context.WithTimeout(ctx, goBuildTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(buildCtx, goExe, buildArgs...)
+		cmd.Dir = dir
+		cmd.Env = append(goToolEnv(), opts.buildEnv()...)
+		out, err := cmd.CombinedOutput()
+		if buildCtx.Err() != nil && ctx.Err() == nil {
+			return out, context.DeadlineExceeded
+		}
+		return out, err
+	}
+	var out []byte
+	withCoverage := false
+	// like play.golang.org we don't run vet as part of running the code
+	goTestArgs := append([]string{"test", "-c", "-vet=off", "-trimpath", "-o", exe}, opts.buildArgs()...)
+	switch {
+	case opts.isBuildOnly():
+		buildArgs := append([]string{"build", "-trimpath", "-o", exe}, opts.buildArgs()...)
+		if isTest {
+			buildArgs = goTestArgs
+		}
+		out, err = build(append(buildArgs, ".")...)
+	case isTest:
+		var isSplit bool
+		isSplit, err = pd.splitTests()
+		if err != nil {
+			return nil, err
+		}
+		coverMode := "count"
+		if opts != nil && opts.Race {
+			coverMode = "atomic"
+		}
+		coverArgs := append(slices.Clone(goTestArgs), "-cover", "-covermode="+coverMode, "-coverpkg=./...", ".")
+		out, err = build(coverArgs...)
+		withCoverage = err == nil
+		if err != nil && isSplit && ctx.Err() == nil && !errors.Is(err, context.DeadlineExceeded) {
+			// splitting the code from tests can break compilation e.g.
+			// because of dot imports so try again without coverage
+			err = pd.undoSplitTests()
+			if err != nil {
+				return nil, err
+			}
+			out, err = build(append(goTestArgs, ".")...)
+		}
+	default:
+		buildArgs := append([]string{"build", "-trimpath", "-o", exe}, opts.buildArgs()...)
+		out, err = build(append(buildArgs, ".")...)
+	}
+	if ctx.Err() != nil {
+		msg := "program cancelled"
+		return &CompileResponse{Errors: msg, ErrorInfo: newRunError(0, msg)}, nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &CompileResponse{Errors: "timeout building program"}, nil
+	}
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, err
+		}
+		msg := pd.cleanOutput(string(out))
+		info := newPlayError(phaseBuild, msg)
+		setEndPositions(info.Diagnostics, files)
+		return &CompileResponse{Errors: msg, ErrorInfo: info}, nil
+	}
+	if opts.isBuildOnly() {
+		// the code compiled for the target platform, there's nothing to run
+		return &CompileResponse{IsTest: isTest, GoVersion: goVersionOf(goExe)}, nil
+	}
+	var args []string
+	if isTest {
+		args = testArgs(r.limits)
+		if withCoverage {
+			args = append(args, "-test.coverprofile="+filepath.Join(dir, coverProfileName))
+		}
+	}
+	env := []string{fmt.Sprintf("GOMEMLIMIT=%dMiB", r.limits.MemoryMB)}
+	env = append(env, opts.runEnv()...)
+	res, err := runSandboxed(ctx, dir, exe, args, env, r.limits, onEvent)
+	if err != nil {
+		return nil, err
+	}
+	res.GoVersion = goVersionOf(goExe)
+	if isTest {
+		addTestReport(res, pd)
+	}
+	if withCoverage {
+		addCoverage(res, pd)
+	}
+	return res, nil
+}
+
+// eventsRecorder collects stdout and stderr of a program as CompileEvent
+// records. It's shared by stdout and stderr writers so must be thread-safe
+type eventsRecorder struct {
+	mu        sync.Mutex
+	events    []*CompileEvent
+	lastEvent time.Time
+	size      int
+	maxSize   int
+	// called once when the output exceeds maxSize
+	onOverflow func()
+	overflow   bool
+	// if set, called with every chunk of output, before merging.
+	// It's called from a separate goroutine, in order, so that a slow
+	// consumer (e.g. a client on a slow connection) doesn't block
+	// collecting the output
+	onEvent func(*CompileEvent)
+	// events not yet passed to onEvent
+	toDeliver []*CompileEvent
+	// signaled when toDeliver or closed changes
+	deliverCond *sync.Cond
+	closed      bool
+	// closed when all events were passed to onEvent
+	delivered chan struct{}
+}
+
+func newEventsRecorder(maxSize int, onOverflow func(), onEvent func(*CompileEvent)) *eventsRecorder {
+	r := &eventsRecorder{
+		lastEvent:  time.Now(),
+		maxSize:    maxSize,
+		onOverflow: onOverflow,
+		onEvent:    onEvent,
+		delivered:  make(chan struct{}),
+	}
+	r.deliverCond = sync.NewCond(&r.mu)
+	if onEvent == nil {
+		close(r.delivered)
+	} else {
+		go r.deliverEvents()
+	}
+	return r
+}
+
+func (r *eventsRecorder) deliverEvents() {
+	defer close(r.delivered)
+	for {
+		r.mu.Lock()
+		for len(r.toDeliver) == 0 && !r.closed {
+			r.deliverCond.Wait()
+		}
+		events := r.toDeliver
+		r.toDeliver = nil
+		closed := r.closed
+		r.mu.Unlock()
+		for _, ev := range events {
+			r.onEvent(ev)
+		}
+		if closed && len(events) == 0 {
+			return
+		}
+	}
+}
+
+// close waits until all events were passed to onEvent
+func (r *eventsRecorder) close() {
+	r.mu.Lock()
+	r.closed = true
+	r.deliverCond.Signal()
+	r.mu.Unlock()
+	<-r.delivered
+}
+
+func (r *eventsRecorder) add(kind string, d []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.overflow {
+		return
+	}
+	if r.size+len(d) > r.maxSize {
+		d = d[:r.maxSize-r.size]
+		r.overflow = true
+		r.onOverflow()
+	}
+	r.size += len(d)
+	r.appendLocked(kind, string(d))
+}
+
+// add a message generated by us, not the program, so not subject to limits
+func (r *eventsRecorder) addMessage(kind string, msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.appendLocked(kind, msg)
+}
+
+func (r *eventsRecorder) appendLocked(kind string, msg string) {
+	now := time.Now()
+	delay := now.Sub(r.lastEvent)
+	r.lastEvent = now
+	if r.onEvent != nil {
+		r.toDeliver = append(r.toDeliver, &CompileEvent{
+			Message: msg,
+			Kind:    kind,
+			Delay:   delay,
+		})
+		r.deliverCond.Signal()
+	}
+	// merge writes that happen in quick succession to reduce number of events
+	if n := len(r.events); n > 0 && delay < 10*time.Millisecond {
+		if last := r.events[n-1]; last.Kind == kind {
+			last.Message += msg
+			return
+		}
+	}
+	ev := &CompileEvent{
+		Message: msg,
+		Kind:    kind,
+		Delay:   delay,
+	}
+	r.events = append(r.events, ev)
+}
+
+func (r *eventsRecorder) writer(kind string) *eventsWriter {
+	return &eventsWriter{rec: r, kind: kind}
+}
+
+type eventsWriter struct {
+	rec  *eventsRecorder
+	kind string
+}
+
+func (w *eventsWriter) Write(d []byte) (int, error) {
+	w.rec.add(w.kind, d)
+	return len(d), nil
+}
+
+// runs already built program exe in dir with limits
+// the program only gets HOME, TMPDIR and PATH env variables and env
+func runSandboxed(parentCtx context.Context, dir string, exe string, args []string, env []string, limits *runLimits, onEvent func(*CompileEvent)) (*CompileResponse, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, limits.Timeout)
+	defer cancel()
+
+	rec := newEventsRecorder(limits.MaxOutput, cancel, onEvent)
+	cmd := sandboxCommand(ctx, dir, exe, args, limits)
+	cmd.Dir = dir
+	cmd.Env = []string{
+		"HOME=" + dir,
+		"TMPDIR=" + dir,
+		"PATH=/usr/bin:/bin",
+	}
+	// later values over-ride earlier values
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout = rec.writer("stdout")
+	cmd.Stderr = rec.writer("stderr")
+	timeStart := time.Now()
+	err := cmd.Run()
+	dur := time.Since(timeStart)
+
+	res := &CompileResponse{}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		rec.close()
+		return nil, err
+	}
+	if exitErr != nil {
+		res.Status = exitErr.ExitCode()
+	}
+	addMsg := func(msg string) {
+		rec.addMessage("stderr", "\n"+msg+"\n")
+		res.ErrorInfo = newRunError(res.Status, msg)
+	}
+	switch {
+	case rec.overflow:
+		addMsg("output too large, program killed")
+	case parentCtx.Err() != nil:
+		addMsg("program cancelled")
+	case ctx.Err() != nil:
+		addMsg("timeout running program")
+		res.ErrorInfo.Phase = phaseTimeout
+	case exitErr != nil && res.Status == -1:
+		// killed by a signal e.g. SIGXCPU when exceeded cpu limit
+		addMsg(fmt.Sprintf("program killed: %s", exitErr))
+	}
+	rec.close()
+	res.Events = rec.events
+	logf("runSandboxed: '%s' finished in %s, status: %d, output size: %d\n", exe, dur, res.Status, rec.size)
+	return res, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+// snippets shared with /api/goplay/share are stored in data dir
+// as ${id}.go, where id is derived from the content, so sharing
+// the same code twice returns the same id
+
+// same length of id as play.golang.org
+const snippetIDLen = 11
+
+// default max total size of stored snippets
+const snippetsMaxSizeDefault = 256 * 1024 * 1024
+
+// salt so that our ids are different from play.golang.org ids for the same content
+const snippetIDSalt = "edna-snippet-v1"
+
+var (
+	// ids from play.golang.org are also base64 url encoded
+	rxSnippetID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+	muSnippets  sync.Mutex
+	// total size of files in snippets dir, -1 until calculated
+	snippetsSize int64 = -1
+
+	// errSnippetsFull is returned when saving a snippet would go over
+	// the limit. Snippets are never deleted because links to them
+	// must keep working
+	errSnippetsFull = errors.New("snippet storage is full")
+)
+
+func snippetsMaxSize() int64 {
+	if config.GoSnippetsMaxMB > 0 {
+		return int64(config.GoSnippetsMaxMB) * 1024 * 1024
+	}
+	return snippetsMaxSizeDefault
+}
+
+func getSnippetsDirMust() string {
+	res := filepath.Join(getDataDirMust(), "snippets")
+	err := os.MkdirAll(res, 0755)
+	must(err)
+	return res
+}
+
+func isValidSnippetID(id string) bool {
+	return rxSnippetID.MatchString(id)
+}
+
+func snippetID(body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, snippetIDSalt)
+	h.Write(body)
+	sum := h.Sum(nil)
+	return base64.RawURLEncoding.EncodeToString(sum)[:snippetIDLen]
+}
+
+func snippetPath(id string) string {
+	return filepath.Join(getSnippetsDirMust(), id+".go")
+}
+
+// returns os.ErrNotExist if we don't have snippet with this id
+func loadSnippetLocal(id string) ([]byte, error) {
+	muSnippets.Lock()
+	defer muSnippets.Unlock()
+	return os.ReadFile(snippetPath(id))
+}
+
+func saveSnippetLocal(id string, body []byte) error {
+	muSnippets.Lock()
+	defer muSnippets.Unlock()
+	path := snippetPath(id)
+	if _, err := os.Stat(path); err == nil {
+		// same id means same content
+		return nil
+	}
+	if snippetsSize < 0 {
+		snippetsSize = dirSize(getSnippetsDirMust())
+	}
+	if snippetsSize+int64(len(body)) > snippetsMaxSize() {
+		return errSnippetsFull
+	}
+	// write to temp file and rename so that we never have partially written snippets
+	tmpPath := path + ".tmp"
+	err := os.WriteFile(tmpPath, body, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+	snippetsSize += int64(len(body))
+	return nil
+}
+
+// returns id of the snippet
+func shareSnippet(body []byte) (string, error) {
+	id := snippetID(body)
+	err := saveSnippetLocal(id, body)
+	if err != nil {
+		return "", err
+	}
+	logf("shareSnippet: saved snippet '%s' of size %d\n", id, len(body))
+	return id, nil
+}
+
+// loadSnippet returns snippet saved locally or, if we don't have it,
+// imports it from play.golang.org
+func loadSnippet(id string) ([]byte, error) {
+	d, err := loadSnippetLocal(id)
+	if err == nil {
+		return d, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	d, err = loadSnippetUpstream(id)
+	if err != nil {
+		return nil, err
+	}
+	// so that it keeps working even if upstream goes away
+	err = saveSnippetLocal(id, d)
+	if err != nil {
+		logf("loadSnippet: saveSnippetLocal('%s') failed with '%s'\n", id, err)
+	} else {
+		logf("loadSnippet: imported snippet '%s' from play.golang.org\n", id)
+	}
+	return d, nil
+}
+
+// errSnippetNotFound is returned by loadSnippetUpstream when play.golang.org doesn't have the snippet
+var errSnippetNotFound = errors.New("snippet not found")
+
+func loadSnippetUpstream(id string) ([]byte, error) {
+	rsp, err := upstreamPlayground.Get("https://play.golang.org/p/" + id + ".go")
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusNotFound {
+		return nil, errSnippetNotFound
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, e("loadSnippetUpstream: got status code %d", rsp.StatusCode)
+	}
+	d, err := io.ReadAll(io.LimitReader(rsp.Body, maxSnippetSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(d) > maxSnippetSize {
+		return nil, errors.New("snippet is too large")
+	}
+	return d, nil
+}
+
+// GET /s/${id} : open the snippet in a new note
+func handleOpenSnippet(w http.ResponseWriter, r *http.Request, id string) {
+	if !isValidSnippetID(id) {
+		http.NotFound(w, r)
+		return
+	}
+	// the frontend creates the note
+	tempRedirect(w, r, "/?snippet="+id)
+}
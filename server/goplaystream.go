@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// StreamStart is the first event sent by /api/goplay/stream.
+// ID can be used to cancel the program with /api/goplay/cancel?id=${ID}
+type StreamStart struct {
+	ID string
+}
+
+// StreamQueued is sent while the program waits for its turn to run.
+// Position is 1 for the next program to run
+type StreamQueued struct {
+	Position int
+}
+
+// StreamExit is the last event sent by /api/goplay/stream
+type StreamExit struct {
+	// formatted source code, only set if different than what was sent
+	Body *string `json:",omitempty"`
+	// compilation errors
+	Errors    string
+	Status    int
+	ErrorInfo *PlayError `json:",omitempty"`
+	Duration  time.Duration
+	GoVersion string `json:",omitempty"`
+	Cached    bool   `json:",omitempty"`
+	// true if the program had no main() and we ran tests
+	IsTest      bool `json:",omitempty"`
+	TestsFailed int  `json:",omitempty"`
+	// results of tests, only for tests run locally
+	Tests *TestReport `json:",omitempty"`
+	// coverage of the code by tests, only for tests run locally
+	Coverage *CoverageReport `json:",omitempty"`
+	// options the code was built and run with
+	Options *RunOptions `json:",omitempty"`
+}
+
+var (
+	muRunningPrograms sync.Mutex
+	runningPrograms   = map[string]context.CancelFunc{}
+)
+
+func genRunID() string {
+	var d [8]byte
+	_, err := rand.Read(d[:])
+	must(err)
+	return hex.EncodeToString(d[:])
+}
+
+func registerRunningProgram(cancel context.CancelFunc) string {
+	id := genRunID()
+	muRunningPrograms.Lock()
+	runningPrograms[id] = cancel
+	muRunningPrograms.Unlock()
+	return id
+}
+
+func unregisterRunningProgram(id string) {
+	muRunningPrograms.Lock()
+	delete(runningPrograms, id)
+	muRunningPrograms.Unlock()
+}
+
+// returns false if there's no program with this id
+func cancelRunningProgram(id string) bool {
+	muRunningPrograms.Lock()
+	cancel := runningPrograms[id]
+	muRunningPrograms.Unlock()
+	if cancel == nil {
+		return false
+	}
+	cancel()
+	return true
+}
+
+// sseWriter sends server-sent events
+// https://developer.mozilla.org/en-US/docs/Web/API/Server-sent_events/Using_server-sent_events
+type sseWriter struct {
+	mu sync.Mutex
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func newSSEWriter(w http.ResponseWriter) *sseWriter {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// tell reverse proxies (Caddy, Cloudflare) to not buffer the response
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	return &sseWriter{
+		w:  w,
+		rc: http.NewResponseController(w),
+	}
+}
+
+func (s *sseWriter) send(event string, v any) {
+	d, err := json.Marshal(v)
+	must(err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// errors mean that the client went away, which also cancels the program
+	_, _ = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, d)
+	_ = s.rc.Flush()
+}
+
+// waitForRunSlot is like acquireRunSlot but for streaming responses. We can't
+// send 429 after we started streaming so the position in the queue is sent as
+// "queued" (StreamQueued) events and errors are returned as a message
+func waitForRunSlot(ctx context.Context, sse *sseWriter) (func(), string) {
+	initGoPlayLimits()
+	onPosition := func(pos int) {
+		sse.send("queued", &StreamQueued{Position: pos})
+	}
+	release, err := goRunQueue.Acquire(ctx, onPosition)
+	if errors.Is(err, errQueueFull) {
+		return nil, "Too many programs waiting to run, try again later"
+	}
+	if err != nil {
+		return nil, "program cancelled"
+	}
+	return release, ""
+}
+
+// POST /api/goplay/stream
+// formats and runs the code, sending the output as server-sent events:
+// "start" (StreamStart), "stdout" and "stderr" (CompileEvent), "exit" (StreamExit)
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	opts, err := parseRunOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request data", http.StatusInternalServerError)
+		return
+	}
+	body := string(bodyBytes)
+	fmtResponse, err := formatGo(body, r.FormValue("go"))
+	if err != nil {
+		logf("streamHandler: formatGo() failed with '%s'\n", err)
+		serveUpstreamError(w, err, "Failed to format source code")
+		return
+	}
+
+	// the default server write timeout might be shorter than building and running
+	limits := getRunLimits()
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Now().Add(goBuildTimeout + limits.Timeout + 10*time.Second))
+
+	sse := newSSEWriter(w)
+	exit := &StreamExit{}
+	if fmtResponse.Body != body {
+		exit.Body = &fmtResponse.Body
+	}
+	legacyErrors := wantsLegacyErrors(r)
+	sendExit := func(info *PlayError) {
+		exit.ErrorInfo = info
+		if !legacyErrors {
+			exit.Errors = ""
+		}
+		sse.send("exit", exit)
+	}
+	if fmtResponse.Error != "" {
+		exit.Errors = fmtResponse.Error
+		sendExit(fmtResponse.ErrorInfo)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	id := registerRunningProgram(cancel)
+	defer unregisterRunningProgram(id)
+	sse.send("start", &StreamStart{ID: id})
+
+	release, msg := waitForRunSlot(ctx, sse)
+	if release == nil {
+		exit.Errors = msg
+		sendExit(newRunError(0, msg))
+		return
+	}
+	defer release()
+
+	onEvent := func(ev *CompileEvent) {
+		sse.send(ev.Kind, ev)
+	}
+	timeStart := time.Now()
+	req := &runRequest{
+		Body:      fmtResponse.Body,
+		GoVersion: r.FormValue("go"),
+		Options:   opts,
+	}
+	res, err := getGoRunner().Run(ctx, req, onEvent)
+	exit.Duration = time.Since(timeStart)
+	if err != nil {
+		logf("streamHandler: goRunner.Run() failed with '%s'\n", err)
+		msg := "Failed to compile source code"
+		if errors.Is(err, errUpstreamUnavailable) {
+			msg += ": upstream service is unavailable, try again later"
+		}
+		exit.Errors = msg
+		sendExit(newPlayError(phaseBuild, msg))
+		return
+	}
+	exit.Errors = res.Errors
+	exit.Status = res.Status
+	exit.GoVersion = res.GoVersion
+	exit.Cached = res.Cached
+	exit.IsTest = res.IsTest
+	exit.TestsFailed = res.TestsFailed
+	exit.Tests = res.Tests
+	exit.Coverage = res.Coverage
+	exit.Options = opts
+	sendExit(res.ErrorInfo)
+}
+
+// POST /api/goplay/cancel?id=${id}
+// kills the program started with /api/goplay/stream
+func cancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.FormValue("id")
+	if !cancelRunningProgram(id) {
+		http.NotFound(w, r)
+		return
+	}
+	logf("cancelHandler: cancelled program '%s'\n", id)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"go/ast"
+	"go/doc"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// programs that are tests must be in _test.go file
+const testProgName = "prog_test.go"
+
+// TestResult is the result of a single test, example or benchmark
+type TestResult struct {
+	Name string
+	// "pass", "fail" or "skip"
+	Status   string
+	Duration time.Duration
+	Output   string
+	// only set for benchmarks
+	Iterations  int64   `json:",omitempty"`
+	NsPerOp     float64 `json:",omitempty"`
+	BytesPerOp  int64   `json:",omitempty"`
+	AllocsPerOp int64   `json:",omitempty"`
+	// only set for examples with "// Output:" comment
+	// true if the output matched
+	OutputOK *bool `json:",omitempty"`
+}
+
+// TestReport is the result of running tests, examples and benchmarks
+// of a program without main()
+type TestReport struct {
+	Passed  int
+	Failed  int
+	Skipped int
+	Tests   []*TestResult
+}
+
+// isTestName reports if name is a test, example or benchmark function
+// according to the same rules as go test: "Testfoo" is not a test
+func isTestName(name, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	if len(name) == len(prefix) {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(name[len(prefix):])
+	return !unicode.IsLower(r)
+}
+
+// isTestProgram returns true if package main doesn't have main()
+// but has tests, examples, benchmarks or fuzz targets
+func isTestProgram(files *programFiles) bool {
+	hasTests := false
+	for _, name := range files.rootGoFiles() {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, name, files.data[name], parser.SkipObjectResolution)
+		if err != nil {
+			return false
+		}
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil {
+				continue
+			}
+			name := fn.Name.Name
+			if name == "main" {
+				return false
+			}
+			if isTestName(name, "Test") || isTestName(name, "Example") || isTestName(name, "Benchmark") || isTestName(name, "Fuzz") {
+				hasTests = true
+			}
+		}
+	}
+	return hasTests
+}
+
+// returns names of example functions that check their output
+func examplesWithOutput(files *programFiles) map[string]bool {
+	res := map[string]bool{}
+	for _, name := range files.rootGoFiles() {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, name, files.data[name], parser.ParseComments)
+		if err != nil {
+			continue
+		}
+		for _, ex := range doc.Examples(f) {
+			if ex.Output != "" || ex.EmptyOutput {
+				res["Example"+ex.Name] = true
+			}
+		}
+	}
+	return res
+}
+
+// arguments for test binary built with go test -c
+func testArgs(limits *runLimits) []string {
+	return []string{
+		"-test.v",
+		"-test.run=.",
+		"-test.bench=.",
+		"-test.benchmem",
+		// go test's timeout panics with stacks of all goroutines
+		// which is more useful than being killed by us
+		"-test.timeout=" + max(limits.Timeout-time.Second, limits.Timeout/2).String(),
+	}
+}
+
+var (
+	// "--- PASS: TestFoo (0.00s)", indented for sub-tests
+	rxTestResult = regexp.MustCompile(`^\s*--- (PASS|FAIL|SKIP): (\S+) \(([\d.]+)s\)`)
+	// "=== RUN   TestFoo", "=== PAUSE TestFoo", "=== CONT  TestFoo"
+	rxTestFrame = regexp.MustCompile(`^=== (?:RUN|PAUSE|CONT|NAME)\s+(\S+)`)
+	// "BenchmarkFoo-8   	 1000000	      1234 ns/op	      16 B/op	       1 allocs/op"
+	rxBenchResult = regexp.MustCompile(`^(Benchmark\S*?)(?:-\d+)?\s+(\d+)\s+([\d.]+) ns/op(?:\s+(\d+) B/op)?(?:\s+(\d+) allocs/op)?`)
+	// benchmark name printed before running it
+	rxBenchName = regexp.MustCompile(`^(Benchmark\S*?)(?:-\d+)?$`)
+)
+
+// parseTestOutput parses output of test binary run with -test.v
+func parseTestOutput(out string, examplesWithOutput map[string]bool) *TestReport {
+	res := &TestReport{}
+	byName := map[string]*TestResult{}
+	get := func(name string) *TestResult {
+		if tr := byName[name]; tr != nil {
+			return tr
+		}
+		tr := &TestResult{Name: name}
+		byName[name] = tr
+		res.Tests = append(res.Tests, tr)
+		return tr
+	}
+	var curr *TestResult
+	// no empty line after the final newline
+	out = strings.TrimSuffix(out, "\n")
+	for _, line := range strings.Split(out, "\n") {
+		if m := rxTestFrame.FindStringSubmatch(line); m != nil {
+			curr = get(m[1])
+			continue
+		}
+		if m := rxTestResult.FindStringSubmatch(line); m != nil {
+			// output after result line belongs to the test e.g. got/want for examples
+			curr = get(m[2])
+			curr.Status = strings.ToLower(m[1])
+			secs, _ := strconv.ParseFloat(m[3], 64)
+			curr.Duration = time.Duration(secs * float64(time.Second))
+			continue
+		}
+		if m := rxBenchResult.FindStringSubmatch(line); m != nil {
+			curr = get(m[1])
+			curr.Status = "pass"
+			curr.Iterations, _ = strconv.ParseInt(m[2], 10, 64)
+			curr.NsPerOp, _ = strconv.ParseFloat(m[3], 64)
+			curr.BytesPerOp, _ = strconv.ParseInt(m[4], 10, 64)
+			curr.AllocsPerOp, _ = strconv.ParseInt(m[5], 10, 64)
+			curr.Duration = time.Duration(float64(curr.Iterations) * curr.NsPerOp)
+			continue
+		}
+		if m := rxBenchName.FindStringSubmatch(line); m != nil {
+			curr = get(m[1])
+			continue
+		}
+		switch {
+		case line == "PASS" || line == "FAIL":
+			curr = nil
+			continue
+		case strings.HasPrefix(line, "goos: "), strings.HasPrefix(line, "goarch: "),
+			strings.HasPrefix(line, "pkg: "), strings.HasPrefix(line, "cpu: "):
+			curr = nil
+			continue
+		}
+		if curr != nil {
+			curr.Output += line + "\n"
+		}
+	}
+
+	for _, tr := range res.Tests {
+		if tr.Status == "" {
+			// didn't finish e.g. panicked or timed out
+			tr.Status = "fail"
+		}
+		if examplesWithOutput[tr.Name] && tr.Status != "skip" {
+			ok := tr.Status == "pass"
+			tr.OutputOK = &ok
+		}
+		switch tr.Status {
+		case "pass":
+			res.Passed++
+		case "fail":
+			res.Failed++
+		case "skip":
+			res.Skipped++
+		}
+	}
+	return res
+}
+
+func addTestReport(res *CompileResponse, pd *programDir) {
+	var out strings.Builder
+	for _, ev := range res.Events {
+		if ev.Kind == "stdout" {
+			out.WriteString(ev.Message)
+		}
+	}
+	res.IsTest = true
+	res.Tests = parseTestOutput(out.String(), examplesWithOutput(pd.Files))
+	for _, tr := range res.Tests.Tests {
+		tr.Output = pd.renameFiles(tr.Output)
+	}
+	res.TestsFailed = res.Tests.Failed
+}
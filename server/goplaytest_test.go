@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTestOutput(t *testing.T) {
+	type want struct {
+		name       string
+		status     string
+		duration   time.Duration
+		output     string
+		iterations int64
+		nsPerOp    float64
+		bytesPerOp int64
+		allocs     int64
+		outputOK   *bool
+	}
+	yes, no := true, false
+	tests := []struct {
+		name     string
+		out      string
+		examples map[string]bool
+		passed   int
+		failed   int
+		skipped  int
+		want     []want
+	}{
+		{
+			name:   "passing test",
+			out:    "=== RUN   TestFoo\n--- PASS: TestFoo (0.01s)\nPASS\n",
+			passed: 1,
+			want: []want{
+				{name: "TestFoo", status: "pass", duration: 10 * time.Millisecond},
+			},
+		},
+		{
+			name:   "failing test with output",
+			out:    "=== RUN   TestFoo\n    prog_test.go:5: got 1, want 2\n--- FAIL: TestFoo (0.00s)\nFAIL\n",
+			failed: 1,
+			want: []want{
+				{name: "TestFoo", status: "fail", output: "    prog_test.go:5: got 1, want 2\n"},
+			},
+		},
+		{
+			name:    "skipped and sub-tests",
+			out:     "=== RUN   TestA\n=== RUN   TestA/sub\n--- PASS: TestA (0.00s)\n    --- PASS: TestA/sub (0.00s)\n=== RUN   TestB\n--- SKIP: TestB (0.00s)\nPASS\n",
+			passed:  2,
+			skipped: 1,
+			want: []want{
+				{name: "TestA", status: "pass"},
+				{name: "TestA/sub", status: "pass"},
+				{name: "TestB", status: "skip"},
+			},
+		},
+		{
+			name:   "test that didn't finish",
+			out:    "=== RUN   TestPanic\npanic: boom\n",
+			failed: 1,
+			want: []want{
+				{name: "TestPanic", status: "fail", output: "panic: boom\n"},
+			},
+		},
+		{
+			name:     "examples with output",
+			out:      "=== RUN   ExampleGood\n--- PASS: ExampleGood (0.00s)\n=== RUN   ExampleBad\n--- FAIL: ExampleBad (0.00s)\ngot:\n1\nwant:\n2\nFAIL\n",
+			examples: map[string]bool{"ExampleGood": true, "ExampleBad": true},
+			passed:   1,
+			failed:   1,
+			want: []want{
+				{name: "ExampleGood", status: "pass", outputOK: &yes},
+				{name: "ExampleBad", status: "fail", output: "got:\n1\nwant:\n2\n", outputOK: &no},
+			},
+		},
+		{
+			name:   "benchmark",
+			out:    "goos: linux\ngoarch: amd64\npkg: play\ncpu: Some CPU\nBenchmarkFoo\nBenchmarkFoo-8   \t 1000000\t      1234 ns/op\t      16 B/op\t       1 allocs/op\nPASS\n",
+			passed: 1,
+			want: []want{
+				{name: "BenchmarkFoo", status: "pass", duration: 1234 * time.Millisecond, iterations: 1000000, nsPerOp: 1234, bytesPerOp: 16, allocs: 1},
+			},
+		},
+		{
+			name: "no tests",
+			out:  "testing: warning: no tests to run\nPASS\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := parseTestOutput(tt.out, tt.examples)
+			if res.Passed != tt.passed || res.Failed != tt.failed || res.Skipped != tt.skipped {
+				t.Errorf("passed/failed/skipped: got %d/%d/%d, want %d/%d/%d", res.Passed, res.Failed, res.Skipped, tt.passed, tt.failed, tt.skipped)
+			}
+			if len(res.Tests) != len(tt.want) {
+				t.Fatalf("got %d tests, want %d", len(res.Tests), len(tt.want))
+			}
+			for i, w := range tt.want {
+				got := res.Tests[i]
+				if got.Name != w.name || got.Status != w.status || got.Output != w.output {
+					t.Errorf("test %d: got %q %q %q, want %q %q %q", i, got.Name, got.Status, got.Output, w.name, w.status, w.output)
+				}
+				if got.Duration != w.duration {
+					t.Errorf("%s: duration got %s, want %s", w.name, got.Duration, w.duration)
+				}
+				if got.Iterations != w.iterations || got.NsPerOp != w.nsPerOp || got.BytesPerOp != w.bytesPerOp || got.AllocsPerOp != w.allocs {
+					t.Errorf("%s: benchmark got %d %v %d %d", w.name, got.Iterations, got.NsPerOp, got.BytesPerOp, got.AllocsPerOp)
+				}
+				if (got.OutputOK == nil) != (w.outputOK == nil) || (got.OutputOK != nil && *got.OutputOK != *w.outputOK) {
+					t.Errorf("%s: OutputOK got %v, want %v", w.name, got.OutputOK, w.outputOK)
+				}
+			}
+		})
+	}
+}
+
+func TestIsTestName(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		want   bool
+	}{
+		{"Test", "Test", true},
+		{"TestFoo", "Test", true},
+		{"Test_foo", "Test", true},
+		{"Testfoo", "Test", false},
+		{"BenchmarkX", "Benchmark", true},
+		{"Foo", "Test", false},
+	}
+	for _, tt := range tests {
+		if got := isTestName(tt.name, tt.prefix); got != tt.want {
+			t.Errorf("isTestName(%q, %q) = %v, want %v", tt.name, tt.prefix, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"path"
+	"strings"
+
+	"golang.org/x/tools/txtar"
+)
+
+// Like play.golang.org, a snippet can have multiple files in txtar format:
+//
+//	package main
+//	...
+//	-- go.mod --
+//	module play
+//	-- util/util.go --
+//	package util
+//
+// The text before the first file is prog.go.
+// https://pkg.go.dev/golang.org/x/tools/txtar
+
+const maxSnippetFiles = 32
+
+// programFiles is a program split into files
+type programFiles struct {
+	// in the order they appear in the snippet
+	names []string
+	data  map[string][]byte
+	// true if prog.go is the text before the first file in txtar
+	progInComment bool
+}
+
+func (pf *programFiles) add(name string, d []byte) {
+	pf.names = append(pf.names, name)
+	pf.data[name] = d
+}
+
+func (pf *programFiles) isMultiFile() bool {
+	return len(pf.names) > 1 || pf.names[0] != progName
+}
+
+// returns names of .go files in the root directory i.e. package main
+func (pf *programFiles) rootGoFiles() []string {
+	var res []string
+	for _, name := range pf.names {
+		if strings.HasSuffix(name, ".go") && !strings.Contains(name, "/") {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// archive is the reverse of splitFiles
+func (pf *programFiles) archive() []byte {
+	if !pf.isMultiFile() {
+		return pf.data[progName]
+	}
+	a := &txtar.Archive{}
+	for _, name := range pf.names {
+		if name == progName && pf.progInComment {
+			a.Comment = pf.data[name]
+			continue
+		}
+		a.Files = append(a.Files, txtar.File{Name: name, Data: pf.data[name]})
+	}
+	return txtar.Format(a)
+}
+
+func validateFileName(name string) error {
+	switch {
+	case name == "":
+		return e("file name is empty")
+	case strings.Contains(name, `\`):
+		return e("file name '%s' contains backslash", name)
+	case path.IsAbs(name):
+		return e("file name '%s' is absolute", name)
+	case path.Clean(name) != name || name == "." || !fs.ValidPath(name):
+		return e("file name '%s' is invalid", name)
+	}
+	return nil
+}
+
+// splitFiles splits the snippet into files. Snippets that are not
+// txtar archives are a single prog.go file
+func splitFiles(body []byte) (*programFiles, error) {
+	res := &programFiles{
+		data: map[string][]byte{},
+	}
+	a := txtar.Parse(body)
+	if len(a.Files) == 0 {
+		res.add(progName, body)
+		return res, nil
+	}
+	if len(a.Files) > maxSnippetFiles {
+		return nil, e("too many files in txtar archive: %d, max is %d", len(a.Files), maxSnippetFiles)
+	}
+	if len(bytes.TrimSpace(a.Comment)) > 0 {
+		res.add(progName, a.Comment)
+		res.progInComment = true
+	}
+	for _, f := range a.Files {
+		if err := validateFileName(f.Name); err != nil {
+			return nil, err
+		}
+		if _, ok := res.data[f.Name]; ok {
+			return nil, e("duplicate file name '%s'", f.Name)
+		}
+		res.add(f.Name, f.Data)
+	}
+	return res, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSplitFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		names []string
+		// file name => content
+		data    map[string]string
+		wantErr string
+	}{
+		{
+			name:  "single file",
+			body:  "package main\n\nfunc main() {}\n",
+			names: []string{progName},
+			data:  map[string]string{progName: "package main\n\nfunc main() {}\n"},
+		},
+		{
+			name:  "prog.go before the first file",
+			body:  "package main\n-- go.mod --\nmodule play\n-- util/util.go --\npackage util\n",
+			names: []string{progName, "go.mod", "util/util.go"},
+			data: map[string]string{
+				progName:       "package main\n",
+				"go.mod":       "module play\n",
+				"util/util.go": "package util\n",
+			},
+		},
+		{
+			name:  "only named files",
+			body:  "-- prog.go --\npackage main\n-- a.go --\npackage main\n",
+			names: []string{progName, "a.go"},
+		},
+		{
+			name:    "duplicate file",
+			body:    "-- a.go --\npackage main\n-- a.go --\npackage main\n",
+			wantErr: "duplicate file name 'a.go'",
+		},
+		{
+			name:    "absolute path",
+			body:    "-- /etc/passwd --\nroot\n",
+			wantErr: "is absolute",
+		},
+		{
+			name:    "parent directory",
+			body:    "-- ../x.go --\npackage main\n",
+			wantErr: "is invalid",
+		},
+		{
+			name:    "parent directory itself",
+			body:    "-- .. --\npackage main\n",
+			wantErr: "is invalid",
+		},
+		{
+			name:    "parent directory in the middle",
+			body:    "-- a/../../x.go --\npackage main\n",
+			wantErr: "is invalid",
+		},
+		{
+			name:    "current directory",
+			body:    "-- . --\npackage main\n",
+			wantErr: "is invalid",
+		},
+		{
+			name:    "unclean path",
+			body:    "-- a//b.go --\npackage main\n",
+			wantErr: "is invalid",
+		},
+		{
+			name:    "backslash",
+			body:    "-- a\\b.go --\npackage main\n",
+			wantErr: "contains backslash",
+		},
+		{
+			name:    "too many files",
+			body:    strings.Repeat("-- a.go --\n", maxSnippetFiles+1),
+			wantErr: "too many files",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pf, err := splitFiles([]byte(tt.body))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(pf.names, tt.names) {
+				t.Errorf("got names %v, want %v", pf.names, tt.names)
+			}
+			for name, want := range tt.data {
+				if got := string(pf.data[name]); got != want {
+					t.Errorf("%s: got %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProgramFilesArchive(t *testing.T) {
+	bodies := []string{
+		"package main\n\nfunc main() {}\n",
+		"package main\n-- go.mod --\nmodule play\n-- util/util.go --\npackage util\n",
+		"-- prog.go --\npackage main\n-- a.go --\npackage main\n",
+	}
+	for _, body := range bodies {
+		pf, err := splitFiles([]byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(pf.archive()); got != body {
+			t.Errorf("archive() got %q, want %q", got, body)
+		}
+	}
+}
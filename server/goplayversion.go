@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Go code can be run with a specific version of Go, selected with ?go=${version}
+// upstream: play.golang.org has 3 backends: latest release (""), previous
+// release ("goprev") and tip ("gotip")
+// local: go in PATH or one of Config.GoToolchains
+
+// after go env failed, don't try again sooner than this
+const goEnvRetryFreq = 30 * time.Second
+
+type goEnvCached struct {
+	v string
+	// zero if the value is valid, otherwise when go env failed
+	failed time.Time
+}
+
+var (
+	muGoVersions sync.Mutex
+	// maps "${goExe} ${name}" to the value of go env variable
+	localGoEnv = map[string]*goEnvCached{}
+)
+
+// returns value of go env variable of go toolchain e.g. GOROOT or "" if failed
+func goEnvOf(goExe string, name string) string {
+	key := goExe + " " + name
+	muGoVersions.Lock()
+	c := localGoEnv[key]
+	muGoVersions.Unlock()
+	if c != nil && (c.failed.IsZero() || time.Since(c.failed) < goEnvRetryFreq) {
+		return c.v
+	}
+	// concurrent callers might both run go env, which is fine
+	c = &goEnvCached{}
+	cmd := exec.Command(goExe, "env", name)
+	cmd.Env = goToolEnv()
+	out, err := cmd.Output()
+	if err != nil {
+		logf("goEnvOf: '%s env %s' failed with '%s'\n", goExe, name, err)
+		c.failed = time.Now()
+	} else {
+		c.v = strings.TrimSpace(string(out))
+	}
+	muGoVersions.Lock()
+	localGoEnv[key] = c
+	muGoVersions.Unlock()
+	return c.v
+}
+
+// returns version of go toolchain e.g. "go1.22.3" or "" if failed
+func goVersionOf(goExe string) string {
+	return goEnvOf(goExe, "GOVERSION")
+}
+
+// "go1.22.3" => "go1.22"
+func goRelease(version string) string {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return version
+	}
+	return parts[0] + "." + parts[1]
+}
+
+func localGoVersionNames() []string {
+	var res []string
+	for name := range config.GoToolchains {
+		res = append(res, name)
+	}
+	slices.Sort(res)
+	return res
+}
+
+// localGoExe returns path of go executable for a given version
+func localGoExe(version string) (string, error) {
+	if version == "" {
+		return "go", nil
+	}
+	if dir, ok := config.GoToolchains[version]; ok {
+		return filepath.Join(dir, "bin", "go"), nil
+	}
+	// e.g. "go1.22" when go in PATH is go1.22.3
+	if v := goVersionOf("go"); version == v || version == goRelease(v) {
+		return "go", nil
+	}
+	names := append([]string{goRelease(goVersionOf("go"))}, localGoVersionNames()...)
+	return "", e("Go version '%s' is not available, available versions: %s", version, strings.Join(names, ", "))
+}
+
+// upstreamURL returns url of play.golang.org api for a given backend
+func upstreamURL(path string, backend string) string {
+	// goprevplay.golang.org and gotipplay.golang.org
+	return "https://" + backend + "play.golang.org" + path
+}
+
+// UpstreamVersion is returned by play.golang.org/version
+type UpstreamVersion struct {
+	Version string
+	Release string
+	Name    string
+}
+
+type upstreamVersionCached struct {
+	v       *UpstreamVersion
+	fetched time.Time
+}
+
+var (
+	upstreamVersions      = map[string]*upstreamVersionCached{}
+	upstreamVersionMaxAge = time.Hour
+)
+
+func fetchUpstreamVersion(backend string) (*UpstreamVersion, error) {
+	rsp, err := upstreamPlayground.Get(upstreamURL("/version", backend))
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, e("fetchUpstreamVersion: got status code %d", rsp.StatusCode)
+	}
+	d, err := io.ReadAll(io.LimitReader(rsp.Body, 4096))
+	if err != nil {
+		return nil, err
+	}
+	res := &UpstreamVersion{}
+	err = json.Unmarshal(d, res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func getUpstreamVersion(backend string) (*UpstreamVersion, error) {
+	muGoVersions.Lock()
+	c := upstreamVersions[backend]
+	muGoVersions.Unlock()
+	if c != nil && time.Since(c.fetched) < upstreamVersionMaxAge {
+		return c.v, nil
+	}
+	v, err := fetchUpstreamVersion(backend)
+	if err != nil {
+		if c != nil {
+			// better stale than nothing
+			return c.v, nil
+		}
+		return nil, err
+	}
+	muGoVersions.Lock()
+	upstreamVersions[backend] = &upstreamVersionCached{v: v, fetched: time.Now()}
+	muGoVersions.Unlock()
+	return v, nil
+}
+
+// returns version of go used by upstream backend e.g. "go1.22.3"
+func upstreamGoVersion(backend string) string {
+	v, err := getUpstreamVersion(backend)
+	if err != nil {
+		logf("upstreamGoVersion: getUpstreamVersion('%s') failed with '%s'\n", backend, err)
+		if backend == "" {
+			return ""
+		}
+		return backend
+	}
+	return v.Version
+}
+
+// upstreamBackendForVersion maps version like "go1.22" to upstream backend
+func upstreamBackendForVersion(version string) (string, error) {
+	switch version {
+	case "", "gotip", "goprev":
+		return version, nil
+	}
+	var available []string
+	for _, backend := range []string{"", "goprev"} {
+		v, err := getUpstreamVersion(backend)
+		if err != nil {
+			return "", err
+		}
+		if version == v.Version || version == v.Release {
+			return backend, nil
+		}
+		available = append(available, v.Release)
+	}
+	available = append(available, "gotip")
+	return "", e("Go version '%s' is not available, available versions: %s", version, strings.Join(available, ", "))
+}
+
+// GoVersionsResponse is returned by /api/goplay/versions
+type GoVersionsResponse struct {
+	// version used when ?go= is not given
+	Default string
+	// values that can be used in ?go=
+	Versions []string
+}
+
+// GET /api/goplay/versions
+func versionsHandler(w http.ResponseWriter, r *http.Request) {
+	res := &GoVersionsResponse{}
+	if isLocalGoRunBackend() {
+		res.Default = goVersionOf("go")
+		res.Versions = append([]string{goRelease(res.Default)}, localGoVersionNames()...)
+	} else {
+		res.Default = upstreamGoVersion("")
+		for _, backend := range []string{"", "goprev"} {
+			if v, err := getUpstreamVersion(backend); err == nil {
+				res.Versions = append(res.Versions, v.Release)
+			}
+		}
+		res.Versions = append(res.Versions, "gotip")
+	}
+	d, err := json.Marshal(res)
+	must(err)
+	serveJSON(w, d)
+}
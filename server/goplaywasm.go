@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Go code can be compiled to WebAssembly and run in the browser with
+// wasm_exec.js so that untrusted code doesn't run on the server
+// POST /api/goplay/wasm : compiles the code, returns WasmResponse
+// GET /api/goplay/wasm/${hash}.wasm : compiled code
+// GET /api/goplay/wasm_exec.js : support code matching the go version
+
+// WasmResponse is the response of POST /api/goplay/wasm
+type WasmResponse struct {
+	// e.g. /api/goplay/wasm/${hash}.wasm, empty if compilation failed
+	URL  string `json:",omitempty"`
+	Size int64  `json:",omitempty"`
+	// true if the program had no main() and we compiled tests
+	IsTest    bool   `json:",omitempty"`
+	GoVersion string `json:",omitempty"`
+	// true if the code was compiled before
+	Cached bool `json:",omitempty"`
+	// compilation errors, same as in CompileResponse
+	Errors    string
+	ErrorInfo *PlayError `json:",omitempty"`
+}
+
+// default max size of all cached .wasm files
+const wasmCacheMaxSizeDefault = 256 * 1024 * 1024
+
+var (
+	// serializes adding and evicting cached files
+	muWasmCache sync.Mutex
+	rxWasmName  = regexp.MustCompile(`^[0-9a-f]{64}\.wasm$`)
+)
+
+func getWasmCacheDir() string {
+	return filepath.Join(getDataDirMust(), "goplay-wasm")
+}
+
+func wasmCacheMaxSize() int64 {
+	if config.GoWasmCacheMB > 0 {
+		return int64(config.GoWasmCacheMB) * 1024 * 1024
+	}
+	return wasmCacheMaxSizeDefault
+}
+
+// evictWasmCache deletes least recently used .wasm files until the total size
+// is below the limit. Modification time is updated when a file is used
+func evictWasmCache(dir string, maxSize int64) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil || !rxWasmName.MatchString(e.Name()) {
+			continue
+		}
+		files = append(files, fi)
+		total += fi.Size()
+	}
+	slices.SortFunc(files, func(a, b os.FileInfo) int {
+		return a.ModTime().Compare(b.ModTime())
+	})
+	for _, fi := range files {
+		if total <= maxSize {
+			break
+		}
+		path := filepath.Join(dir, fi.Name())
+		if os.Remove(path) == nil {
+			total -= fi.Size()
+			logf("evictWasmCache: removed '%s'\n", path)
+		}
+	}
+}
+
+// compileWasm compiles the code with GOOS=js GOARCH=wasm. Compiled files
+// are cached by hash of the go version and source code
+func compileWasm(ctx context.Context, body string, goVersion string) (*WasmResponse, error) {
+	goExe, err := localGoExe(goVersion)
+	if err != nil {
+		return &WasmResponse{Errors: err.Error(), ErrorInfo: newPlayError(phaseBuild, err.Error())}, nil
+	}
+	files, err := splitFiles([]byte(body))
+	if err != nil {
+		return &WasmResponse{Errors: err.Error(), ErrorInfo: newPlayError(phaseBuild, err.Error())}, nil
+	}
+	res := &WasmResponse{
+		GoVersion: goVersionOf(goExe),
+		IsTest:    isTestProgram(files),
+	}
+	h := sha256.Sum256([]byte(res.GoVersion + "\n" + body))
+	name := hex.EncodeToString(h[:]) + ".wasm"
+	dir := getWasmCacheDir()
+	path := filepath.Join(dir, name)
+	res.URL = "/api/goplay/wasm/" + name
+
+	muWasmCache.Lock()
+	fi, err := os.Stat(path)
+	if err == nil {
+		now := time.Now()
+		_ = os.Chtimes(path, now, now)
+	}
+	muWasmCache.Unlock()
+	if err == nil {
+		res.Size = fi.Size()
+		res.Cached = true
+		return res, nil
+	}
+
+	pd, err := writeProgramDir(goExe, files)
+	if err != nil {
+		return nil, err
+	}
+	defer pd.Remove()
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	// build to a temp file so that we never serve partially written files
+	// must be absolute because go build runs in program's directory
+	tmpPath, err := filepath.Abs(path + "." + genRunID() + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"build", "-trimpath", "-o", tmpPath, "."}
+	if pd.IsTest {
+		args = []string{"test", "-c", "-vet=off", "-trimpath", "-o", tmpPath, "."}
+	}
+	buildCtx, cancel := context.WithTimeout(ctx, goBuildTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(buildCtx, goExe, args...)
+	cmd.Dir = pd.Dir
+	cmd.Env = append(goToolEnv(), "GOOS=js", "GOARCH=wasm")
+	out, err := cmd.CombinedOutput()
+	if buildCtx.Err() != nil {
+		os.Remove(tmpPath)
+		msg := "timeout building program"
+		return &WasmResponse{Errors: msg, ErrorInfo: newPlayError(phaseTimeout, msg)}, nil
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, err
+		}
+		msg := pd.cleanOutput(string(out))
+		info := newPlayError(phaseBuild, msg)
+		setEndPositions(info.Diagnostics, files)
+		return &WasmResponse{Errors: msg, ErrorInfo: info}, nil
+	}
+	muWasmCache.Lock()
+	defer muWasmCache.Unlock()
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err = os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	res.Size = fi.Size()
+	logf("compileWasm: compiled '%s', size: %d\n", path, res.Size)
+	evictWasmCache(dir, wasmCacheMaxSize())
+	return res, nil
+}
+
+// POST /api/goplay/wasm?go=${version}
+func wasmHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, maxSnippetSize+1))
+	if err != nil {
+		http.Error(w, "Failed to read request data", http.StatusInternalServerError)
+		return
+	}
+	if len(bodyBytes) > maxSnippetSize {
+		http.Error(w, "Snippet is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	release := acquireRunSlot(w, r)
+	if release == nil {
+		return
+	}
+	defer release()
+	res, err := compileWasm(r.Context(), string(bodyBytes), r.FormValue("go"))
+	if err != nil {
+		logf("wasmHandler: compileWasm() failed with '%s'\n", err)
+		http.Error(w, "Failed to compile source code", http.StatusInternalServerError)
+		return
+	}
+	if !wantsLegacyErrors(r) {
+		res.Errors = ""
+	}
+	d, err := json.Marshal(res)
+	must(err)
+	serveJSON(w, d)
+}
+
+// GET /api/goplay/wasm/${hash}.wasm
+func wasmFileHandler(w http.ResponseWriter, r *http.Request, name string) {
+	if !rxWasmName.MatchString(name) {
+		http.NotFound(w, r)
+		return
+	}
+	path := filepath.Join(getWasmCacheDir(), name)
+	f, err := os.Open(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	// name is hash of the content so it never changes
+	w.Header().Set("Content-Type", "application/wasm")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
+
+// GET /api/goplay/wasm_exec.js?go=${version}
+// wasm_exec.js must match the version of go that compiled the code
+func wasmExecHandler(w http.ResponseWriter, r *http.Request) {
+	goExe, err := localGoExe(r.FormValue("go"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	goRoot := goEnvOf(goExe, "GOROOT")
+	if goRoot == "" {
+		http.Error(w, "Failed to find wasm_exec.js", http.StatusInternalServerError)
+		return
+	}
+	// moved from misc/wasm to lib/wasm in go1.24
+	for _, dir := range []string{"lib", "misc"} {
+		path := filepath.Join(goRoot, dir, "wasm", "wasm_exec.js")
+		if _, err := os.Stat(path); err == nil {
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+			http.ServeFile(w, r, path)
+			return
+		}
+	}
+	http.Error(w, "Failed to find wasm_exec.js", http.StatusInternalServerError)
+}
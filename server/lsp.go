@@ -0,0 +1,807 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// LanguageServerConfig describes how to start a language server
+// for /api/lsp/${lang}
+type LanguageServerConfig struct {
+	// command and arguments e.g. ["pylsp"]
+	Command []string
+	// name of the virtual document with the content of the block e.g. "main.py"
+	FileName string
+	// files created in the workspace root e.g. {"go.mod": "module play\n"}
+	RootFiles map[string]string
+	// sent to the server as initializationOptions
+	InitializationOptions json.RawMessage
+	// the server is stopped when it had no clients for that long
+	// 0 means the default of 5 minutes
+	IdleTimeoutSec int
+}
+
+// the client uses this uri for the block, we translate it to uri of the
+// virtual document on disk and back
+const lspBlockURI = "edna:block"
+
+// client requests we pass to the language server, everything else is rejected
+var lspAllowedRequests = []string{
+	"textDocument/hover",
+	"textDocument/completion",
+	"completionItem/resolve",
+	"textDocument/signatureHelp",
+}
+
+// requests and notifications we pass to the language server that don't
+// refer to a document, all others must refer to lspBlockURI
+var lspRequestsWithoutDocument = []string{
+	"completionItem/resolve",
+}
+
+// env variables of the server passed to language servers. Others, like
+// secrets, must not be visible to the language server
+var lspEnvKeys = []string{
+	"PATH", "HOME", "TMPDIR", "USER", "LANG", "LC_ALL",
+	"XDG_CACHE_HOME", "XDG_CONFIG_HOME",
+	"GOROOT", "GOPATH", "GOCACHE", "GOMODCACHE",
+}
+
+func lspEnv() []string {
+	var env []string
+	for _, k := range lspEnvKeys {
+		if v, ok := os.LookupEnv(k); ok {
+			env = append(env, k+"="+v)
+		}
+	}
+	// like goToolEnv(), gopls must not download modules or toolchains
+	// cgo would run C compiler on code from the client
+	return append(env, "GOWORK=off", "GOTOOLCHAIN=local", "GOPROXY=off", "CGO_ENABLED=0")
+}
+
+// getLanguageServerConfig returns nil if there's no language server for lang
+// gopls is used for Go blocks if it's installed and not configured otherwise
+func getLanguageServerConfig(lang string) *LanguageServerConfig {
+	if conf := config.LanguageServers[lang]; conf != nil {
+		return conf
+	}
+	if lang != "golang" {
+		return nil
+	}
+	if _, err := exec.LookPath("gopls"); err != nil {
+		return nil
+	}
+	return &LanguageServerConfig{
+		Command:  []string{"gopls"},
+		FileName: progName,
+		RootFiles: map[string]string{
+			"go.mod": goModContent("go"),
+		},
+	}
+}
+
+// jsonrpcMessage is a request, response or notification
+type jsonrpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+}
+
+type jsonrpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (m *jsonrpcMessage) isRequest() bool {
+	return len(m.ID) > 0 && m.Method != ""
+}
+
+func (m *jsonrpcMessage) isResponse() bool {
+	return len(m.ID) > 0 && m.Method == ""
+}
+
+// readLSPMessage reads a message in "Content-Length: ${n}\r\n\r\n${json}" format
+func readLSPMessage(r *bufio.Reader) ([]byte, error) {
+	contentLength := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		name, val, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			contentLength, err = strconv.Atoi(strings.TrimSpace(val))
+			if err != nil {
+				return nil, fmt.Errorf("invalid Content-Length header '%s'", line)
+			}
+		}
+	}
+	if contentLength < 0 {
+		return nil, errors.New("missing Content-Length header")
+	}
+	d := make([]byte, contentLength)
+	_, err := io.ReadFull(r, d)
+	return d, err
+}
+
+func fileURI(path string) string {
+	u := &url.URL{Scheme: "file", Path: filepath.ToSlash(path)}
+	return u.String()
+}
+
+// pendingRequest is a request sent to the language server waiting for response
+type pendingRequest struct {
+	// for requests from clients
+	session *lspSession
+	origID  json.RawMessage
+	// for our own requests
+	ch chan *jsonrpcMessage
+}
+
+// lspProcess is a running language server shared by all clients
+// for a given language. Each client has its own directory in rootDir
+type lspProcess struct {
+	lang    string
+	conf    *LanguageServerConfig
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	rootDir string
+	// result of initialize request, we send it to clients
+	initResult json.RawMessage
+
+	muWrite sync.Mutex
+
+	mu        sync.Mutex
+	nextID    int64
+	pending   map[int64]*pendingRequest
+	sessions  map[string]*lspSession
+	idleTimer *time.Timer
+	dead      bool
+}
+
+// lspStart is a language server being started
+type lspStart struct {
+	// closed when starting finished
+	done chan struct{}
+	err  error
+}
+
+var (
+	muLSPProcesses sync.Mutex
+	lspProcesses   = map[string]*lspProcess{}
+	// starting can take a long time so it's done without holding
+	// muLSPProcesses. Clients of the same language wait for it
+	lspStarting = map[string]*lspStart{}
+)
+
+func startLSPProcess(lang string, conf *LanguageServerConfig) (*lspProcess, error) {
+	rootDir, err := os.MkdirTemp("", "edna-lsp-"+lang+"-")
+	if err != nil {
+		return nil, err
+	}
+	for name, content := range conf.RootFiles {
+		err = os.WriteFile(filepath.Join(rootDir, name), []byte(content), 0644)
+		if err != nil {
+			os.RemoveAll(rootDir)
+			return nil, err
+		}
+	}
+	p := &lspProcess{
+		lang:     lang,
+		conf:     conf,
+		rootDir:  rootDir,
+		pending:  map[int64]*pendingRequest{},
+		sessions: map[string]*lspSession{},
+	}
+	p.cmd = exec.Command(conf.Command[0], conf.Command[1:]...)
+	p.cmd.Dir = rootDir
+	p.cmd.Env = lspEnv()
+	p.stdin, err = p.cmd.StdinPipe()
+	if err != nil {
+		os.RemoveAll(rootDir)
+		return nil, err
+	}
+	stdout, err := p.cmd.StdoutPipe()
+	if err != nil {
+		os.RemoveAll(rootDir)
+		return nil, err
+	}
+	err = p.cmd.Start()
+	if err != nil {
+		os.RemoveAll(rootDir)
+		return nil, err
+	}
+	logf("startLSPProcess: started '%s' for '%s' in '%s'\n", strings.Join(conf.Command, " "), lang, rootDir)
+	go p.readLoop(stdout)
+
+	err = p.initialize()
+	if err != nil {
+		p.kill()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *lspProcess) initialize() error {
+	initOpts := p.conf.InitializationOptions
+	if len(initOpts) == 0 {
+		initOpts = json.RawMessage("null")
+	}
+	params := map[string]any{
+		"processId": os.Getpid(),
+		"rootUri":   fileURI(p.rootDir),
+		"capabilities": map[string]any{
+			"textDocument": map[string]any{
+				"hover": map[string]any{
+					"contentFormat": []string{"markdown", "plaintext"},
+				},
+				"completion": map[string]any{
+					"completionItem": map[string]any{
+						"snippetSupport": false,
+					},
+				},
+				"signatureHelp":      map[string]any{},
+				"publishDiagnostics": map[string]any{},
+			},
+			"workspace": map[string]any{
+				"configuration": true,
+			},
+		},
+		"initializationOptions": initOpts,
+		"workspaceFolders": []map[string]string{
+			{"uri": fileURI(p.rootDir), "name": "edna"},
+		},
+	}
+	res, err := p.call("initialize", params, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	p.initResult = res
+	return p.notify("initialized", map[string]any{})
+}
+
+// call sends our own request and waits for the response
+func (p *lspProcess) call(method string, params any, timeout time.Duration) (json.RawMessage, error) {
+	ch := make(chan *jsonrpcMessage, 1)
+	id := p.addPending(&pendingRequest{ch: ch})
+	err := p.send(&jsonrpcMessage{ID: json.RawMessage(strconv.FormatInt(id, 10)), Method: method, Params: mustMarshal(params)})
+	if err != nil {
+		p.removePending(id)
+		return nil, err
+	}
+	select {
+	case msg := <-ch:
+		if msg == nil {
+			return nil, fmt.Errorf("language server for '%s' exited", p.lang)
+		}
+		if msg.Error != nil {
+			return nil, fmt.Errorf("%s failed with '%s'", method, msg.Error.Message)
+		}
+		return msg.Result, nil
+	case <-time.After(timeout):
+		p.removePending(id)
+		return nil, fmt.Errorf("%s timed out after %s", method, timeout)
+	}
+}
+
+func (p *lspProcess) notify(method string, params any) error {
+	return p.send(&jsonrpcMessage{Method: method, Params: mustMarshal(params)})
+}
+
+func mustMarshal(v any) json.RawMessage {
+	d, err := json.Marshal(v)
+	must(err)
+	return d
+}
+
+func (p *lspProcess) addPending(pr *pendingRequest) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextID++
+	p.pending[p.nextID] = pr
+	return p.nextID
+}
+
+func (p *lspProcess) removePending(id int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pending, id)
+}
+
+func (p *lspProcess) send(msg *jsonrpcMessage) error {
+	msg.JSONRPC = "2.0"
+	d, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	p.muWrite.Lock()
+	defer p.muWrite.Unlock()
+	_, err = fmt.Fprintf(p.stdin, "Content-Length: %d\r\n\r\n%s", len(d), d)
+	return err
+}
+
+func (p *lspProcess) readLoop(stdout io.Reader) {
+	r := bufio.NewReader(stdout)
+	for {
+		d, err := readLSPMessage(r)
+		if err != nil {
+			logf("lspProcess.readLoop: language server for '%s' exited: '%s'\n", p.lang, err)
+			break
+		}
+		var msg jsonrpcMessage
+		if err = json.Unmarshal(d, &msg); err != nil {
+			logf("lspProcess.readLoop: invalid message from '%s': '%s'\n", p.lang, err)
+			continue
+		}
+		p.handleMessage(&msg)
+	}
+	p.onExit()
+}
+
+func (p *lspProcess) handleMessage(msg *jsonrpcMessage) {
+	switch {
+	case msg.isRequest():
+		p.handleServerRequest(msg)
+	case msg.isResponse():
+		id, err := strconv.ParseInt(string(msg.ID), 10, 64)
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		pr := p.pending[id]
+		delete(p.pending, id)
+		p.mu.Unlock()
+		if pr == nil {
+			return
+		}
+		if pr.ch != nil {
+			pr.ch <- msg
+			return
+		}
+		msg.ID = pr.origID
+		pr.session.sendToClient(msg)
+	case msg.Method == "textDocument/publishDiagnostics":
+		var params struct {
+			URI string `json:"uri"`
+		}
+		if json.Unmarshal(msg.Params, &params) != nil {
+			return
+		}
+		if s := p.sessionByURI(params.URI); s != nil {
+			s.sendToClient(msg)
+		}
+	}
+	// other notifications like progress or log messages are not interesting to clients
+}
+
+// we act as a client for requests from the language server
+func (p *lspProcess) handleServerRequest(msg *jsonrpcMessage) {
+	res := &jsonrpcMessage{ID: msg.ID, Result: json.RawMessage("null")}
+	if msg.Method == "workspace/configuration" {
+		// default configuration for every requested item
+		var params struct {
+			Items []json.RawMessage `json:"items"`
+		}
+		_ = json.Unmarshal(msg.Params, &params)
+		res.Result = mustMarshal(make([]any, len(params.Items)))
+	}
+	_ = p.send(res)
+}
+
+func (p *lspProcess) sessionByURI(uri string) *lspSession {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range p.sessions {
+		if s.uri == uri {
+			return s
+		}
+	}
+	return nil
+}
+
+func (p *lspProcess) idleTimeout() time.Duration {
+	if p.conf.IdleTimeoutSec > 0 {
+		return time.Duration(p.conf.IdleTimeoutSec) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+func (p *lspProcess) isDead() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dead
+}
+
+// must be called with muLSPProcesses locked so that the process
+// is not stopped for being idle at the same time. Returns false
+// if the process already exited
+func (p *lspProcess) addSession(s *lspSession) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.dead {
+		return false
+	}
+	p.sessions[s.id] = s
+	if p.idleTimer != nil {
+		p.idleTimer.Stop()
+		p.idleTimer = nil
+	}
+	return true
+}
+
+func (p *lspProcess) removeSession(s *lspSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.sessions, s.id)
+	for id, pr := range p.pending {
+		if pr.session == s {
+			delete(p.pending, id)
+		}
+	}
+	if len(p.sessions) == 0 && !p.dead {
+		p.idleTimer = time.AfterFunc(p.idleTimeout(), p.stopIfIdle)
+	}
+}
+
+func (p *lspProcess) stopIfIdle() {
+	muLSPProcesses.Lock()
+	p.mu.Lock()
+	idle := len(p.sessions) == 0
+	if idle && lspProcesses[p.lang] == p {
+		delete(lspProcesses, p.lang)
+	}
+	p.mu.Unlock()
+	muLSPProcesses.Unlock()
+	if !idle {
+		return
+	}
+	logf("lspProcess.stopIfIdle: stopping language server for '%s'\n", p.lang)
+	// polite shutdown, kill if it doesn't exit quickly
+	if _, err := p.call("shutdown", nil, 5*time.Second); err == nil {
+		_ = p.notify("exit", nil)
+	}
+	time.AfterFunc(5*time.Second, p.kill)
+}
+
+func (p *lspProcess) kill() {
+	_ = p.cmd.Process.Kill()
+}
+
+func (p *lspProcess) onExit() {
+	_ = p.cmd.Wait()
+	muLSPProcesses.Lock()
+	if lspProcesses[p.lang] == p {
+		delete(lspProcesses, p.lang)
+	}
+	muLSPProcesses.Unlock()
+
+	p.mu.Lock()
+	p.dead = true
+	for _, pr := range p.pending {
+		if pr.ch != nil {
+			pr.ch <- nil
+		}
+	}
+	p.pending = map[int64]*pendingRequest{}
+	var sessions []*lspSession
+	for _, s := range p.sessions {
+		sessions = append(sessions, s)
+	}
+	p.mu.Unlock()
+	// clients will re-connect and start a new server
+	for _, s := range sessions {
+		s.ws.Close()
+	}
+	os.RemoveAll(p.rootDir)
+}
+
+// getLSPProcess returns running language server for lang, starting
+// it if needed. Returns with muLSPProcesses locked, unless there was
+// an error, so that the caller can add a session
+func getLSPProcess(lang string, conf *LanguageServerConfig) (*lspProcess, error) {
+	for {
+		muLSPProcesses.Lock()
+		if p := lspProcesses[lang]; p != nil {
+			return p, nil
+		}
+		st := lspStarting[lang]
+		if st != nil {
+			muLSPProcesses.Unlock()
+			<-st.done
+			if st.err != nil {
+				return nil, st.err
+			}
+			continue
+		}
+		st = &lspStart{done: make(chan struct{})}
+		lspStarting[lang] = st
+		muLSPProcesses.Unlock()
+
+		p, err := startLSPProcess(lang, conf)
+
+		muLSPProcesses.Lock()
+		delete(lspStarting, lang)
+		if err == nil {
+			lspProcesses[lang] = p
+		}
+		st.err = err
+		close(st.done)
+		muLSPProcesses.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// getLSPSession returns a new session with running language server for lang
+func getLSPSession(lang string, conf *LanguageServerConfig, ws *websocket.Conn) (*lspSession, error) {
+	for {
+		p, err := getLSPProcess(lang, conf)
+		if err != nil {
+			return nil, err
+		}
+		if p.isDead() {
+			// exited before we added it to lspProcesses
+			if lspProcesses[lang] == p {
+				delete(lspProcesses, lang)
+			}
+			muLSPProcesses.Unlock()
+			continue
+		}
+		s, err := newLSPSession(p, conf, ws)
+		if err != nil {
+			muLSPProcesses.Unlock()
+			return nil, err
+		}
+		ok := p.addSession(s)
+		if !ok && lspProcesses[lang] == p {
+			delete(lspProcesses, lang)
+		}
+		muLSPProcesses.Unlock()
+		if ok {
+			return s, nil
+		}
+		os.RemoveAll(filepath.Dir(s.path))
+	}
+}
+
+func newLSPSession(p *lspProcess, conf *LanguageServerConfig, ws *websocket.Conn) (*lspSession, error) {
+	id := genRunID()
+	dir := filepath.Join(p.rootDir, id)
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	fileName := conf.FileName
+	if fileName == "" {
+		fileName = "main"
+	}
+	s := &lspSession{
+		id:   id,
+		p:    p,
+		ws:   ws,
+		path: filepath.Join(dir, fileName),
+	}
+	s.uri = fileURI(s.path)
+	return s, nil
+}
+
+// lspSession connects a single block in the editor with a virtual
+// document in the language server
+type lspSession struct {
+	id string
+	p  *lspProcess
+	ws *websocket.Conn
+	// virtual document on disk
+	path    string
+	uri     string
+	isOpen  bool
+	muWrite sync.Mutex
+}
+
+func (s *lspSession) sendToClient(msg *jsonrpcMessage) {
+	msg.JSONRPC = "2.0"
+	d, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	d = bytes.ReplaceAll(d, []byte(strconv.Quote(s.uri)), []byte(strconv.Quote(lspBlockURI)))
+	s.muWrite.Lock()
+	defer s.muWrite.Unlock()
+	_ = websocket.Message.Send(s.ws, string(d))
+}
+
+func (s *lspSession) replyError(msg *jsonrpcMessage, code int, errMsg string) {
+	s.sendToClient(&jsonrpcMessage{ID: msg.ID, Error: &jsonrpcError{Code: code, Message: errMsg}})
+}
+
+// clientInitResult is the result of initialize request of the language
+// server, but we only support full document sync so that we can keep
+// the document on disk up to date
+func (s *lspSession) clientInitResult() json.RawMessage {
+	var res map[string]any
+	if json.Unmarshal(s.p.initResult, &res) != nil {
+		return s.p.initResult
+	}
+	if caps, ok := res["capabilities"].(map[string]any); ok {
+		// 1 is TextDocumentSyncKind.Full
+		caps["textDocumentSync"] = 1
+	}
+	return mustMarshal(res)
+}
+
+func (s *lspSession) writeDocument(text string) {
+	err := os.WriteFile(s.path, []byte(text), 0644)
+	if err != nil {
+		logf("lspSession.writeDocument: os.WriteFile('%s') failed with '%s'\n", s.path, err)
+	}
+}
+
+// isBlockDocument returns true if msg refers to the block's document.
+// Clients must not be able to ask about other files on the server,
+// including documents of other sessions
+func isBlockDocument(msg *jsonrpcMessage) bool {
+	var params struct {
+		TextDocument struct {
+			URI string `json:"uri"`
+		} `json:"textDocument"`
+	}
+	if json.Unmarshal(msg.Params, &params) != nil {
+		return false
+	}
+	return params.TextDocument.URI == lspBlockURI
+}
+
+func (s *lspSession) handleClientMessage(msg *jsonrpcMessage) {
+	switch msg.Method {
+	case "initialize", "shutdown", "initialized", "exit":
+		// handled by us, not sent to the language server
+	default:
+		if slices.Contains(lspRequestsWithoutDocument, msg.Method) || isBlockDocument(msg) {
+			break
+		}
+		if msg.isRequest() {
+			// -32602 is InvalidParams
+			s.replyError(msg, -32602, "only "+lspBlockURI+" document is supported")
+		}
+		return
+	}
+	msg.Params = bytes.ReplaceAll(msg.Params, []byte(strconv.Quote(lspBlockURI)), []byte(strconv.Quote(s.uri)))
+	switch msg.Method {
+	case "initialize":
+		s.sendToClient(&jsonrpcMessage{ID: msg.ID, Result: s.clientInitResult()})
+		return
+	case "shutdown":
+		s.sendToClient(&jsonrpcMessage{ID: msg.ID, Result: json.RawMessage("null")})
+		return
+	case "initialized", "exit":
+		return
+	case "textDocument/didOpen":
+		var params struct {
+			TextDocument struct {
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if json.Unmarshal(msg.Params, &params) != nil {
+			return
+		}
+		s.writeDocument(params.TextDocument.Text)
+		s.isOpen = true
+	case "textDocument/didChange":
+		var params struct {
+			ContentChanges []struct {
+				Range *json.RawMessage `json:"range"`
+				Text  string           `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if json.Unmarshal(msg.Params, &params) != nil {
+			return
+		}
+		if n := len(params.ContentChanges); n > 0 && params.ContentChanges[n-1].Range == nil {
+			s.writeDocument(params.ContentChanges[n-1].Text)
+		}
+	case "textDocument/didClose":
+		s.isOpen = false
+	default:
+		if !msg.isRequest() {
+			return
+		}
+		if !slices.Contains(lspAllowedRequests, msg.Method) {
+			// -32601 is MethodNotFound
+			s.replyError(msg, -32601, "method not supported: "+msg.Method)
+			return
+		}
+		id := s.p.addPending(&pendingRequest{session: s, origID: msg.ID})
+		msg.ID = json.RawMessage(strconv.FormatInt(id, 10))
+	}
+	_ = s.p.send(msg)
+}
+
+func (s *lspSession) close() {
+	if s.isOpen {
+		params := map[string]any{
+			"textDocument": map[string]string{"uri": s.uri},
+		}
+		_ = s.p.notify("textDocument/didClose", params)
+	}
+	s.p.removeSession(s)
+	os.RemoveAll(filepath.Dir(s.path))
+}
+
+// only allow connections from our own pages
+func checkWebSocketOrigin(conf *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(conf, r)
+	if err != nil {
+		return err
+	}
+	if origin == nil || origin.Host != r.Host {
+		return fmt.Errorf("invalid origin '%v'", origin)
+	}
+	return nil
+}
+
+// /api/lsp/${lang} is a WebSocket that relays LSP JSON-RPC messages between
+// a block in the editor and a language server. The client always refers
+// to the block's document with "edna:block" uri
+func handleLSP(w http.ResponseWriter, r *http.Request) {
+	lang := strings.TrimPrefix(r.URL.Path, "/api/lsp/")
+	conf := getLanguageServerConfig(lang)
+	if conf == nil || len(conf.Command) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if !checkGoPlayRateLimit(w, r) {
+		return
+	}
+	serveSession := func(ws *websocket.Conn) {
+		// the connection lives longer than http server's timeouts
+		_ = ws.SetDeadline(time.Time{})
+		ws.MaxPayloadBytes = 4 * maxSnippetSize
+		s, err := getLSPSession(lang, conf, ws)
+		if err != nil {
+			logf("handleLSP: getLSPSession('%s') failed with '%s'\n", lang, err)
+			return
+		}
+		defer s.close()
+		for {
+			var d []byte
+			err := websocket.Message.Receive(ws, &d)
+			if err != nil {
+				return
+			}
+			var msg jsonrpcMessage
+			if json.Unmarshal(d, &msg) != nil {
+				continue
+			}
+			s.handleClientMessage(&msg)
+		}
+	}
+	srv := websocket.Server{
+		Handshake: checkWebSocketOrigin,
+		Handler:   serveSession,
+	}
+	srv.ServeHTTP(w, r)
+}
@@ -100,6 +100,8 @@ func loadSecrets() {
 	// // those are only required in prod
 	must = flgRunProd
 	getEnv("LOGTASTIC_API_KEY", &logtastic.ApiKey, 30, must)
+	// optional, for fixer.io currency rates
+	getEnv("FIXER_API_KEY", &fixerAPIKey, 16, false)
 	// getEnv("PIRSCH_SECRET", &pirschClientSecret, 64, must)
 	// getEnv("GITHUB_SECRET_ONLINETOOL", &secretGitHubOnlineTool, 40, must)
 	// getEnv("GITHUB_SECRET_TOOLS_ARSLEXIS", &secretGitHubToolsArslexis, 40, must)
@@ -128,6 +130,8 @@ var (
 	// compiled assets served from server/dist directory
 	// mostly for testing that the assets are correctly built
 	flgRunProdLocal bool
+	// over-rides Config.GoRunBackend
+	flgGoRunBackend string
 )
 
 func isDev() bool {
@@ -160,6 +164,7 @@ func main() {
 		flag.BoolVar(&flgUpdateGoDeps, "update-go-deps", false, "update go dependencies")
 		flag.BoolVar(&flgGen, "gen", false, "generate code")
 		flag.BoolVar(&flgAdHoc, "ad-hoc", false, "run ad-hoc code")
+		flag.StringVar(&flgGoRunBackend, "go-run-backend", "", "where to run Go code: 'upstream' or 'local'")
 		flag.Parse()
 	}
 
@@ -234,6 +239,17 @@ func main() {
 	logf("logtatistic server: %s\n", logtastic.Server)
 
 	loadSecrets()
+	loadConfig()
+	if flgGoRunBackend != "" {
+		config.GoRunBackend = flgGoRunBackend
+	}
+	validateGoRunBackend()
+	validateRunners()
+	validateCurrencyProviders()
+	validateCurrencyHistoryProvider()
+	validateCryptoProvider()
+	startCurrencyRatesRefresher()
+	startUpstreamHealthLogger(time.Hour)
 
 	if flgRunDev {
 		runServerDev()
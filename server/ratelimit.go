@@ -0,0 +1,275 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket rate limiter per client.
+// Each client can make burst requests at once and then
+// gets a new token every 1/rate seconds
+type rateLimiter struct {
+	mu sync.Mutex
+	// tokens per second
+	rate  float64
+	burst float64
+	// key is e.g. ip address of the client
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute int, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:      float64(perMinute) / 60,
+		burst:     float64(burst),
+		buckets:   map[string]*tokenBucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from the client's bucket. If there are no tokens,
+// it returns false and how long to wait for the next token
+func (rl *rateLimiter) Allow(key string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	rl.sweep(now)
+	b := rl.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	return false, wait
+}
+
+// forget clients whose buckets are full again so that the map doesn't grow forever
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < time.Minute {
+		return
+	}
+	rl.lastSweep = now
+	fullAfter := time.Duration(rl.burst / rl.rate * float64(time.Second))
+	for key, b := range rl.buckets {
+		if now.Sub(b.last) > fullAfter {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// clientIP returns ip address of the client. In production we're behind
+// Caddy and Cloudflare so we trust their headers, but only if the request
+// comes from localhost
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return host
+	}
+	if ip := r.Header.Get("CF-Connecting-IP"); ip != "" {
+		return ip
+	}
+	if ip := r.Header.Get("X-Real-IP"); ip != "" {
+		return ip
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		// the last address was added by our proxy
+		ips := strings.Split(xff, ",")
+		if ip := strings.TrimSpace(ips[len(ips)-1]); ip != "" {
+			return ip
+		}
+	}
+	return host
+}
+
+// rateLimitKey identifies the client for the purpose of rate limiting
+// TODO: when we have logged in users, limit per user
+func rateLimitKey(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// serveTooManyRequests sends 429 with Retry-After header
+func serveTooManyRequests(w http.ResponseWriter, retryAfter time.Duration, msg string) {
+	secs := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(secs, 1)))
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+// runQueue limits how many programs run at the same time. Others wait
+// in a FIFO queue of limited size
+type runQueue struct {
+	mu         sync.Mutex
+	running    int
+	maxRunning int
+	maxWaiting int
+	// values are *queueWaiter
+	waiting *list.List
+}
+
+type queueWaiter struct {
+	// closed when the waiter got a slot
+	ready chan struct{}
+	// new position in the queue, buffered
+	position chan int
+}
+
+var errQueueFull = errors.New("too many programs waiting to run")
+
+func newRunQueue(maxRunning int, maxWaiting int) *runQueue {
+	return &runQueue{
+		maxRunning: maxRunning,
+		maxWaiting: maxWaiting,
+		waiting:    list.New(),
+	}
+}
+
+// Acquire waits for a slot to run a program. While waiting, onPosition is called
+// with position in the queue, starting with 1. Caller must call release
+func (q *runQueue) Acquire(ctx context.Context, onPosition func(int)) (release func(), err error) {
+	q.mu.Lock()
+	if q.running < q.maxRunning && q.waiting.Len() == 0 {
+		q.running++
+		q.mu.Unlock()
+		return q.release, nil
+	}
+	if q.waiting.Len() >= q.maxWaiting {
+		q.mu.Unlock()
+		return nil, errQueueFull
+	}
+	qw := &queueWaiter{
+		ready:    make(chan struct{}),
+		position: make(chan int, 1),
+	}
+	el := q.waiting.PushBack(qw)
+	pos := q.waiting.Len()
+	q.mu.Unlock()
+
+	if onPosition != nil {
+		onPosition(pos)
+	}
+	for {
+		select {
+		case <-qw.ready:
+			return q.release, nil
+		case pos := <-qw.position:
+			if onPosition != nil {
+				onPosition(pos)
+			}
+		case <-ctx.Done():
+			q.mu.Lock()
+			select {
+			case <-qw.ready:
+				// got the slot at the same time, give it back
+				q.mu.Unlock()
+				q.release()
+			default:
+				q.waiting.Remove(el)
+				q.notifyPositionsLocked()
+				q.mu.Unlock()
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (q *runQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	el := q.waiting.Front()
+	if el == nil {
+		q.running--
+		return
+	}
+	// hand over our slot to the first waiter
+	qw := q.waiting.Remove(el).(*queueWaiter)
+	close(qw.ready)
+	q.notifyPositionsLocked()
+}
+
+func (q *runQueue) notifyPositionsLocked() {
+	pos := 1
+	for el := q.waiting.Front(); el != nil; el = el.Next() {
+		qw := el.Value.(*queueWaiter)
+		// replace not yet received position with the new one
+		select {
+		case <-qw.position:
+		default:
+		}
+		qw.position <- pos
+		pos++
+	}
+}
+
+var (
+	goPlayRateLimiter *rateLimiter
+	goRunQueue        *runQueue
+	goPlayLimitsOnce  sync.Once
+)
+
+func initGoPlayLimits() {
+	goPlayLimitsOnce.Do(func() {
+		orDefault := func(v int, def int) int {
+			if v > 0 {
+				return v
+			}
+			return def
+		}
+		perMinute := orDefault(config.GoPlayRatePerMinute, 30)
+		burst := orDefault(config.GoPlayRateBurst, 10)
+		maxRunning := orDefault(config.GoRunMaxConcurrent, runtime.NumCPU())
+		maxWaiting := orDefault(config.GoRunMaxQueue, 16)
+		goPlayRateLimiter = newRateLimiter(perMinute, burst)
+		goRunQueue = newRunQueue(maxRunning, maxWaiting)
+		logf("initGoPlayLimits: %d requests per minute, burst: %d, max concurrent runs: %d, max queue: %d\n", perMinute, burst, maxRunning, maxWaiting)
+	})
+}
+
+// checkGoPlayRateLimit sends 429 and returns false if the client is over the limit
+func checkGoPlayRateLimit(w http.ResponseWriter, r *http.Request) bool {
+	initGoPlayLimits()
+	key := rateLimitKey(r)
+	ok, retryAfter := goPlayRateLimiter.Allow(key)
+	if !ok {
+		logf("checkGoPlayRateLimit: '%s' is over the limit, retry after %s\n", key, retryAfter)
+		serveTooManyRequests(w, retryAfter, "Too many requests, try again later")
+	}
+	return ok
+}
+
+// acquireRunSlot waits for a slot to run a program. If the queue is full it
+// sends 429 and returns nil
+func acquireRunSlot(w http.ResponseWriter, r *http.Request) func() {
+	initGoPlayLimits()
+	release, err := goRunQueue.Acquire(r.Context(), nil)
+	if errors.Is(err, errQueueFull) {
+		serveTooManyRequests(w, 5*time.Second, "Too many programs waiting to run, try again later")
+		return nil
+	}
+	if err != nil {
+		// client went away
+		return nil
+	}
+	return release
+}
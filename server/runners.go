@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// RunnerConfig describes how to run code blocks of a given language
+// with a local interpreter
+type RunnerConfig struct {
+	// command and arguments, "${file}" is replaced with the name of
+	// the file with the code e.g. ["python3", "${file}"]
+	Command []string
+	// name of the file we write the code to e.g. "main.py"
+	// the default is "main"
+	FileName string
+	// limits, 0 means the same as for running Go code
+	TimeoutSec  int
+	CPUSec      int
+	MemoryMB    int
+	MaxOutputKB int
+	// names of server's environment variables passed to the program
+	// by default it only gets HOME and TMPDIR (its own directory) and PATH
+	Env []string
+}
+
+const runnerFilePlaceholder = "${file}"
+
+func (rc *RunnerConfig) fileName() string {
+	if rc.FileName != "" {
+		return rc.FileName
+	}
+	return "main"
+}
+
+func (rc *RunnerConfig) limits() *runLimits {
+	res := getRunLimits()
+	if rc.TimeoutSec > 0 {
+		res.Timeout = time.Duration(rc.TimeoutSec) * time.Second
+	}
+	if rc.CPUSec > 0 {
+		res.CPU = time.Duration(rc.CPUSec) * time.Second
+	}
+	if rc.MemoryMB > 0 {
+		res.MemoryMB = rc.MemoryMB
+	}
+	if rc.MaxOutputKB > 0 {
+		res.MaxOutput = rc.MaxOutputKB * 1024
+	}
+	return res
+}
+
+func (rc *RunnerConfig) env() []string {
+	var res []string
+	for _, name := range rc.Env {
+		if v, ok := os.LookupEnv(name); ok {
+			res = append(res, name+"="+v)
+		}
+	}
+	return res
+}
+
+// call at startup to catch mis-configuration early
+func validateRunners() {
+	for lang, rc := range config.Runners {
+		panicIf(rc == nil || len(rc.Command) == 0, "runner for '%s' has no Command", lang)
+		panicIf(filepath.Base(rc.fileName()) != rc.fileName(), "runner for '%s' has invalid FileName '%s'", lang, rc.FileName)
+		path, err := exec.LookPath(rc.Command[0])
+		if err != nil {
+			// not fatal, the interpreter might be installed later
+			logf("validateRunners: warning: '%s' for running '%s' is not installed\n", rc.Command[0], lang)
+			continue
+		}
+		logf("validateRunners: running '%s' with '%s', limits: %+v\n", lang, path, rc.limits())
+	}
+}
+
+// runWithRunner runs code with a local interpreter in a temporary directory
+func runWithRunner(ctx context.Context, rc *RunnerConfig, code []byte, onEvent func(*CompileEvent)) (*CompileResponse, error) {
+	exe, err := exec.LookPath(rc.Command[0])
+	if err != nil {
+		msg := "'" + rc.Command[0] + "' is not installed on the server"
+		return &CompileResponse{Errors: msg, ErrorInfo: newPlayError(phaseRun, msg)}, nil
+	}
+	dir, err := os.MkdirTemp("", "edna-run-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	fileName := rc.fileName()
+	err = os.WriteFile(filepath.Join(dir, fileName), code, 0644)
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	for _, arg := range rc.Command[1:] {
+		args = append(args, strings.ReplaceAll(arg, runnerFilePlaceholder, fileName))
+	}
+	res, err := runSandboxed(ctx, dir, exe, args, rc.env(), rc.limits(), onEvent)
+	if err != nil {
+		return nil, err
+	}
+	res.setErrorInfo()
+	return res, nil
+}
+
+// RunLanguagesResponse is the response of /api/run/languages
+type RunLanguagesResponse struct {
+	Languages []string
+}
+
+// GET /api/run/languages : languages that can be run with /api/run/${lang}
+// POST /api/run/${lang} : runs the code in the body, returns CompileResponse
+func handleRun(w http.ResponseWriter, r *http.Request) {
+	lang := strings.TrimPrefix(r.URL.Path, "/api/run/")
+	if lang == "languages" {
+		res := &RunLanguagesResponse{Languages: []string{}}
+		for lang := range config.Runners {
+			res.Languages = append(res.Languages, lang)
+		}
+		slices.Sort(res.Languages)
+		d, err := json.Marshal(res)
+		must(err)
+		serveJSON(w, d)
+		return
+	}
+	rc := config.Runners[lang]
+	if rc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer r.Body.Close()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	code, err := io.ReadAll(io.LimitReader(r.Body, maxSnippetSize+1))
+	if err != nil {
+		http.Error(w, "Failed to read request data", http.StatusInternalServerError)
+		return
+	}
+	if len(code) > maxSnippetSize {
+		http.Error(w, "Snippet is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !checkGoPlayRateLimit(w, r) {
+		return
+	}
+	release := acquireRunSlot(w, r)
+	if release == nil {
+		return
+	}
+	defer release()
+	res, err := runWithRunner(r.Context(), rc, code, nil)
+	if err != nil {
+		logf("handleRun: runWithRunner() for '%s' failed with '%s'\n", lang, err)
+		http.Error(w, "Failed to run the code", http.StatusInternalServerError)
+		return
+	}
+	d, err := json.Marshal(res)
+	must(err)
+	serveJSON(w, d)
+}
@@ -0,0 +1,284 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// programs run in new user, network, mount and PID namespaces:
+// - network namespace only has a loopback interface, which is down
+// - root is an empty read-only tmpfs with read-only /usr, /bin, /lib etc.,
+//   a few devices, /proc and the directory of the program so that
+//   the program can't read data dir, config or secrets of the server
+// - the program is init of the PID namespace. When it's killed, the kernel
+//   kills all processes it started, even those that called setsid()
+//
+// Mounts can only be set up in the new namespaces so the server re-executes
+// itself as sandboxInitName, which sets up mounts and limits and execs the program
+
+const (
+	sandboxIsolatesNetwork = true
+
+	sandboxInitName = "edna-sandbox-init"
+	// threads count as processes and go programs start a few of them
+	sandboxMaxProcs = 256
+)
+
+// visible to sandboxed programs (read-only) if they exist
+var (
+	sandboxSystemDirs = []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/etc/alternatives", "/etc/ld.so.cache"}
+	sandboxDevices    = []string{"/dev/null", "/dev/zero", "/dev/random", "/dev/urandom"}
+)
+
+// sandboxSpec is passed from sandboxCommand to sandboxInit
+type sandboxSpec struct {
+	// directory of the program, the only writable directory
+	Dir string
+	Exe string
+	// read-only directories
+	Dirs        []string
+	CPUSec      uint64
+	MemoryBytes uint64
+	MaxFileSize uint64
+}
+
+func init() {
+	if len(os.Args) < 2 || os.Args[0] != sandboxInitName {
+		return
+	}
+	// only returns on error
+	err := sandboxInit(os.Args[1], os.Args[2:])
+	fmt.Fprintf(os.Stderr, "sandbox: %s\n", err)
+	os.Exit(126)
+}
+
+// sandboxCommand returns a command that runs exe with limits on cpu time,
+// memory, size of written files and number of processes, without network
+// access and with only system directories and dir visible
+func sandboxCommand(ctx context.Context, dir string, exe string, args []string, limits *runLimits) *exec.Cmd {
+	maxFileSize := limits.MaxFileSize
+	if maxFileSize == 0 {
+		maxFileSize = 2 * limits.MaxOutput
+	}
+	spec := &sandboxSpec{
+		Dir:  dir,
+		Exe:  exe,
+		Dirs: append(slices.Clone(sandboxSystemDirs), config.RunSandboxDirs...),
+		// we limit data segment and not address space because go runtime
+		// reserves a lot of address space upfront and fails to start
+		CPUSec:      uint64(max(int(limits.CPU/time.Second), 1)),
+		MemoryBytes: uint64(limits.MemoryMB) * 1024 * 1024,
+		MaxFileSize: uint64(maxFileSize),
+	}
+	d, err := json.Marshal(spec)
+	must(err)
+	cmd := exec.CommandContext(ctx, "/proc/self/exe")
+	cmd.Args = append([]string{sandboxInitName, string(d)}, args...)
+	uid, gid := os.Getuid(), os.Getgid()
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		// new user namespace allows creating the others without being root
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID,
+		// root in the namespace so that sandboxInit can mount. It drops
+		// capabilities before running the program
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}},
+	}
+	// killing init of the PID namespace kills all processes in it
+	cmd.Cancel = func() error {
+		return cmd.Process.Kill()
+	}
+	// don't wait forever for children that inherited stdout
+	cmd.WaitDelay = time.Second
+	return cmd
+}
+
+// sandboxInit runs in the new namespaces. It sets up the root directory
+// and limits and replaces itself with the program
+func sandboxInit(specJSON string, args []string) error {
+	// capabilities are per-thread and we exec from the thread that drops them
+	runtime.LockOSThread()
+	var spec sandboxSpec
+	err := json.Unmarshal([]byte(specJSON), &spec)
+	if err != nil {
+		return err
+	}
+	err = sandboxMountRoot(&spec)
+	if err != nil {
+		return err
+	}
+	limits := []struct {
+		resource int
+		v        uint64
+	}{
+		{unix.RLIMIT_CPU, spec.CPUSec},
+		{unix.RLIMIT_DATA, spec.MemoryBytes},
+		{unix.RLIMIT_FSIZE, spec.MaxFileSize},
+		{unix.RLIMIT_NPROC, sandboxMaxProcs},
+	}
+	for _, l := range limits {
+		err = unix.Setrlimit(l.resource, &unix.Rlimit{Cur: l.v, Max: l.v})
+		if err != nil {
+			return e("setrlimit(%d) failed with '%s'", l.resource, err)
+		}
+	}
+	err = sandboxDropCapabilities()
+	if err != nil {
+		return err
+	}
+	return unix.Exec(spec.Exe, append([]string{spec.Exe}, args...), os.Environ())
+}
+
+// sandboxMountRoot makes a new root with only the directories from spec
+func sandboxMountRoot(spec *sandboxSpec) error {
+	// don't propagate our mounts to the parent namespace
+	err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, "")
+	if err != nil {
+		return e("making mounts private failed with '%s'", err)
+	}
+	// the new root is mounted over the program's directory so we
+	// keep a reference to it
+	progDir, err := os.Open(spec.Dir)
+	if err != nil {
+		return err
+	}
+	defer progDir.Close()
+	root := spec.Dir
+	err = unix.Mount("tmpfs", root, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "size=1m,mode=0755")
+	if err != nil {
+		return e("mounting tmpfs failed with '%s'", err)
+	}
+	for _, path := range spec.Dirs {
+		err = sandboxBind(root, path, true)
+		if err != nil {
+			return err
+		}
+	}
+	for _, path := range sandboxDevices {
+		err = sandboxBind(root, path, false)
+		if err != nil {
+			return err
+		}
+	}
+	dst := filepath.Join(root, spec.Dir)
+	err = os.MkdirAll(dst, 0755)
+	if err != nil {
+		return err
+	}
+	err = unix.Mount(fmt.Sprintf("/proc/self/fd/%d", progDir.Fd()), dst, "", unix.MS_BIND, "")
+	if err != nil {
+		return e("bind mount of '%s' failed with '%s'", spec.Dir, err)
+	}
+	// needed by os.Executable() e.g. when fuzzing. It fails if the host
+	// masks parts of /proc (e.g. in docker) and then there's no /proc
+	procDir := filepath.Join(root, "proc")
+	err = os.Mkdir(procDir, 0755)
+	if err != nil {
+		return err
+	}
+	_ = unix.Mount("proc", procDir, "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "")
+
+	err = os.Chdir(root)
+	if err != nil {
+		return err
+	}
+	// stacks the old root under the new one, which we then unmount
+	err = unix.PivotRoot(".", ".")
+	if err != nil {
+		return e("pivot_root failed with '%s'", err)
+	}
+	err = unix.Unmount(".", unix.MNT_DETACH)
+	if err != nil {
+		return e("unmounting old root failed with '%s'", err)
+	}
+	err = unix.Mount("", "/", "", unix.MS_REMOUNT|unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV, "")
+	if err != nil {
+		return e("remounting root read-only failed with '%s'", err)
+	}
+	return os.Chdir(spec.Dir)
+}
+
+// sandboxBind makes src visible at the same path in root. Symlinks are
+// copied so that e.g. /bin -> usr/bin works. Missing src is skipped
+func sandboxBind(root string, src string, readOnly bool) error {
+	fi, err := os.Lstat(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(root, src)
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	case fi.IsDir():
+		err = os.Mkdir(dst, 0755)
+	default:
+		err = os.WriteFile(dst, nil, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	err = unix.Mount(src, dst, "", unix.MS_BIND|unix.MS_REC, "")
+	if err != nil {
+		return e("bind mount of '%s' failed with '%s'", src, err)
+	}
+	if !readOnly {
+		return nil
+	}
+	// flags like nodev of the original mount can't be cleared
+	// in a user namespace so we must keep them
+	var st unix.Statfs_t
+	err = unix.Statfs(dst, &st)
+	if err != nil {
+		return err
+	}
+	keep := uintptr(st.Flags) & (unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC | unix.MS_NOATIME | unix.MS_NODIRATIME | unix.MS_RELATIME)
+	err = unix.Mount("", dst, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY|keep, "")
+	if err != nil {
+		return e("remounting '%s' read-only failed with '%s'", src, err)
+	}
+	return nil
+}
+
+// sandboxDropCapabilities drops all capabilities so that the program,
+// which is root in the user namespace, can't undo the mounts
+func sandboxDropCapabilities() error {
+	for c := 0; c <= unix.CAP_LAST_CAP; c++ {
+		err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0)
+		if err == unix.EINVAL {
+			// the kernel doesn't have this capability
+			break
+		}
+		if err != nil {
+			return e("dropping capability %d failed with '%s'", c, err)
+		}
+	}
+	err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+	if err != nil {
+		return err
+	}
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	return unix.Capset(&hdr, &data[0])
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"time"
+)
+
+const sandboxIsolatesNetwork = false
+
+// sandboxCommand returns a command that runs exe. Only Linux supports
+// limiting cpu, memory and network so on other platforms the only limits
+// are the timeout and size of the output. Good enough for local development
+func sandboxCommand(ctx context.Context, dir string, exe string, args []string, limits *runLimits) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, exe, args...)
+	cmd.WaitDelay = time.Second
+	return cmd
+}
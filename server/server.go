@@ -4,8 +4,8 @@ import (
 	"bytes"
 	"context"
 	"embed"
+	"encoding/json"
 	"fmt"
-	"io"
 	"io/fs"
 	"net/http"
 	"net/http/httputil"
@@ -14,7 +14,6 @@ import (
 	"path/filepath"
 	"slices"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/felixge/httpsnoop"
@@ -140,60 +139,24 @@ func handleGithubCallback(w http.ResponseWriter, r *http.Request) {
 	logLogin(ctx, r, token)
 }
 
-var (
-	cachedCurrencyRatesJSON []byte
-	currencyRatesLastUpdate time.Time
-	muCurrency              sync.Mutex
-	currencyUpdateFreq      = time.Hour * 24
-	// https://www.exchangerate-api.com/docs/free, rate limited, updates rates once a day
-	currencyRatesURL1 = "https://open.er-api.com/v6/latest/EUR"
-	// I also have https://apilayer.com/marketplace/fixer-api account
-	// on https://apilayer.com/account
-	// which is free for 100 reqs per month
-)
-
+// getCurrencyRates returns rates from the first currency provider that works
 func getCurrencyRates() ([]byte, error) {
-	rsp, err := http.Get(currencyRatesURL1)
+	rates, err := fetchCurrencyRates()
 	if err != nil {
-		return nil, err
+		return nil, e("getCurrencyRates: %w", err)
 	}
-	defer rsp.Body.Close()
-	if rsp.StatusCode == 200 {
-		return io.ReadAll(rsp.Body)
-	}
-	return nil, e("getCurrencyRates: got status code %d", rsp.StatusCode)
+	return json.Marshal(rates)
 }
 
-// TODO: implement without using https://currencies.heynote.com/rates.json
+// GET /api/currency_rates.json
 func serverApiCurrencyRates(w http.ResponseWriter, r *http.Request) {
-	logf("serverCurrencyRates\n")
-	muCurrency.Lock()
-	defer muCurrency.Unlock()
-
-	if cachedCurrencyRatesJSON != nil {
-		sinceUpdate := time.Since(currencyRatesLastUpdate)
-		logf("serverCurrencyRates: have cached data, since update: %s\n", sinceUpdate)
-		if sinceUpdate < currencyUpdateFreq {
-			logf("serverCurrencyRates: using cached data\n")
-			serveJSON(w, []byte(cachedCurrencyRatesJSON))
-			return
-		}
-	}
-
-	d, err := getCurrencyRates()
+	d, err := getCachedCurrencyRates()
 	if err != nil {
-		logf("serverCurrencyRates: getCurrencyRates() failed with: '%s'\n", err)
-		if cachedCurrencyRatesJSON != nil {
-			serveJSON(w, cachedCurrencyRatesJSON)
-			return
-		}
-		serveInternalError(w, err)
+		logf("serverCurrencyRates: getCachedCurrencyRates() failed with: '%s'\n", err)
+		serveUpstreamError(w, err, "Failed to get currency rates")
 		return
 	}
-	logf("serverCurrencyRates: got data of size %d %s\n", len(d), truncData(d, 64))
-	cachedCurrencyRatesJSON = d
-	currencyRatesLastUpdate = time.Now()
-	serveJSON(w, d)
+	serveCurrencyRates(w, r, d)
 }
 
 func truncData(data []byte, maxLen int) string {
@@ -226,6 +189,9 @@ func makeHTTPServer(serveOpts *hutil.ServeFileOptions, proxyHandler *httputil.Re
 		case "/api/currency_rates.json":
 			serverApiCurrencyRates(w, r)
 			return
+		case "/api/currency_rates/refresh":
+			refreshCurrencyRatesHandler(w, r)
+			return
 			// case "/auth/ghlogin":
 			// 	handleLoginGitHub(w, r)
 			// 	return
@@ -234,10 +200,28 @@ func makeHTTPServer(serveOpts *hutil.ServeFileOptions, proxyHandler *httputil.Re
 			// 	return
 		}
 
+		if day, ok := strings.CutPrefix(uri, "/api/currency_rates/"); ok {
+			currencyRatesForDateHandler(w, r, day)
+			return
+		}
+
 		if strings.HasPrefix(uri, "/api/goplay/") {
 			handleGoPlayground(w, r)
 			return
 		}
+
+		if strings.HasPrefix(uri, "/api/run/") {
+			handleRun(w, r)
+			return
+		}
+		if strings.HasPrefix(uri, "/api/lsp/") {
+			handleLSP(w, r)
+			return
+		}
+		if id, ok := strings.CutPrefix(uri, "/s/"); ok {
+			handleOpenSnippet(w, r, id)
+			return
+		}
 		if strings.HasPrefix(uri, "/event") {
 			logtastic.HandleEvent(w, r)
 			return
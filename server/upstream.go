@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// upstream is an external HTTP service we depend on, like play.golang.org.
+// Requests have a timeout and are retried with jittered exponential backoff.
+// After too many consecutive failures a circuit breaker opens and we fail fast,
+// without calling the service, until cooldown passes. Then we let one request
+// through and close the breaker if it succeeds
+type upstream struct {
+	name       string
+	client     *http.Client
+	maxRetries int
+	// first retry waits up to this long, doubles with every retry
+	retryBackoff time.Duration
+	// number of consecutive failures that opens the circuit breaker
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	mu                  sync.Mutex
+	consecutiveFailures int
+	// if not zero, the breaker is open until then
+	openUntil time.Time
+	// true when the breaker let through a trial request
+	halfOpen bool
+	// stats for logging
+	nOK       int
+	nFailed   int
+	nRejected int
+}
+
+// errUpstreamUnavailable is returned when an upstream service is down,
+// either failed after retries or the circuit breaker is open
+var errUpstreamUnavailable = errors.New("upstream service unavailable")
+
+type upstreamError struct {
+	name string
+	err  error
+}
+
+func (e *upstreamError) Error() string {
+	if e.err == nil {
+		return f("upstream '%s' is unavailable", e.name)
+	}
+	return f("upstream '%s' is unavailable: %s", e.name, e.err)
+}
+
+func (e *upstreamError) Is(target error) bool {
+	return target == errUpstreamUnavailable
+}
+
+func (e *upstreamError) Unwrap() error {
+	return e.err
+}
+
+func newUpstream(name string, timeout time.Duration) *upstream {
+	u := &upstream{
+		name:             name,
+		client:           &http.Client{Timeout: timeout},
+		maxRetries:       2,
+		retryBackoff:     250 * time.Millisecond,
+		breakerThreshold: 5,
+		breakerCooldown:  30 * time.Second,
+	}
+	muUpstreams.Lock()
+	upstreams = append(upstreams, u)
+	muUpstreams.Unlock()
+	return u
+}
+
+var (
+	muUpstreams sync.Mutex
+	upstreams   []*upstream
+
+	upstreamPlayground = newUpstream("play.golang.org", 30*time.Second)
+)
+
+// returns false if the circuit breaker is open
+func (u *upstream) allow() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(u.openUntil) || u.halfOpen {
+		u.nRejected++
+		return false
+	}
+	// cooldown passed, let one request through
+	u.halfOpen = true
+	return true
+}
+
+func (u *upstream) recordResult(ok bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if ok {
+		u.nOK++
+		if !u.openUntil.IsZero() {
+			logf("upstream '%s': circuit breaker closed, service is back\n", u.name)
+		}
+		u.consecutiveFailures = 0
+		u.openUntil = time.Time{}
+		u.halfOpen = false
+		return
+	}
+	u.nFailed++
+	u.consecutiveFailures++
+	if u.halfOpen || u.consecutiveFailures == u.breakerThreshold {
+		logf("upstream '%s': circuit breaker open for %s after %d consecutive failures\n", u.name, u.breakerCooldown, u.consecutiveFailures)
+		u.openUntil = time.Now().Add(u.breakerCooldown)
+		u.halfOpen = false
+	}
+}
+
+// recordCancelled is called when the caller cancelled the request, which
+// says nothing about the health of the upstream. If it was the request
+// let through after the cooldown, the next one will be
+func (u *upstream) recordCancelled() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.halfOpen = false
+}
+
+func isRetryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests
+}
+
+// Do sends the request, retrying on network errors and 5xx responses.
+// Responses with other status codes are returned to the caller.
+// Returned error wraps errUpstreamUnavailable if the upstream is down
+func (u *upstream) Do(req *http.Request) (*http.Response, error) {
+	if !u.allow() {
+		return nil, &upstreamError{name: u.name}
+	}
+	// query can have secrets like api keys so we don't log it
+	uri := *req.URL
+	uri.RawQuery = ""
+	ctx := req.Context()
+	var lastErr error
+	for attempt := 0; attempt <= u.maxRetries; attempt++ {
+		if attempt > 0 {
+			// full jitter: https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+			backoff := u.retryBackoff << (attempt - 1)
+			select {
+			case <-time.After(rand.N(backoff)):
+			case <-ctx.Done():
+				u.recordCancelled()
+				return nil, ctx.Err()
+			}
+			if req.Body != nil {
+				if req.GetBody == nil {
+					break
+				}
+				body, err := req.GetBody()
+				if err != nil {
+					break
+				}
+				req.Body = body
+			}
+		}
+		rsp, err := u.client.Do(req)
+		if err == nil && !isRetryableStatus(rsp.StatusCode) {
+			u.recordResult(true)
+			return rsp, nil
+		}
+		if err == nil {
+			lastErr = e("got status code %d", rsp.StatusCode)
+			io.Copy(io.Discard, io.LimitReader(rsp.Body, 4096))
+			rsp.Body.Close()
+		} else {
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				urlErr.URL = uri.String()
+			}
+			lastErr = err
+		}
+		if ctx.Err() != nil {
+			u.recordCancelled()
+			return nil, ctx.Err()
+		}
+		logf("upstream '%s': %s %s failed (attempt %d): %s\n", u.name, req.Method, uri.String(), attempt+1, lastErr)
+	}
+	u.recordResult(false)
+	return nil, &upstreamError{name: u.name, err: lastErr}
+}
+
+func (u *upstream) Get(uri string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	return u.Do(req)
+}
+
+func (u *upstream) logHealth() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	state := "ok"
+	if !u.openUntil.IsZero() {
+		state = "down"
+	} else if u.consecutiveFailures > 0 {
+		state = "failing"
+	}
+	logf("upstream '%s': %s, ok: %d, failed: %d, rejected: %d\n", u.name, state, u.nOK, u.nFailed, u.nRejected)
+}
+
+// logs health of all upstreams periodically
+func startUpstreamHealthLogger(freq time.Duration) {
+	go func() {
+		for {
+			time.Sleep(freq)
+			muUpstreams.Lock()
+			all := append([]*upstream(nil), upstreams...)
+			muUpstreams.Unlock()
+			for _, u := range all {
+				u.logHealth()
+			}
+		}
+	}()
+}
+
+// serveUpstreamError sends 503 if err is because upstream is unavailable, 500 otherwise
+func serveUpstreamError(w http.ResponseWriter, err error, msg string) {
+	if errors.Is(err, errUpstreamUnavailable) {
+		w.Header().Set("Retry-After", strconv.Itoa(30))
+		http.Error(w, msg+": upstream service is unavailable, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, msg, http.StatusInternalServerError)
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"crypto/subtle"
 	"io"
 	"net/http"
+	"strings"
 )
 
 func serveInternalError(w http.ResponseWriter, err error) {
@@ -18,3 +20,16 @@ func serveJSON(w http.ResponseWriter, data []byte) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(data)
 }
+
+// isAdminRequest returns true if the request has Config.AdminToken
+// in "Authorization: Bearer ${token}" header
+func isAdminRequest(r *http.Request) bool {
+	if config.AdminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1
+}
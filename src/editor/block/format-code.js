@@ -13,7 +13,7 @@ import { lazyLoadPrettier } from "../../lazyimport.js";
 async function formatGo(s) {
   // setProcessingMessage("Formatting code...");
   // const uri = "play.golang.org/fmt";
-  const uri = "/api/goplay/fmt";
+  const uri = "/api/goplay/fmt?errors=v2";
   const rsp = await fetch(uri, {
     method: "POST",
     body: s,
@@ -24,8 +24,8 @@ async function formatGo(s) {
     return null;
   }
   const res = await rsp.json();
-  if (res.Error) {
-    //   setErrorMessage("Error:" + res.Error);
+  if (res.ErrorInfo) {
+    //   setErrorMessage("Error:" + res.ErrorInfo.Message);
     return null;
   }
   if (res.Body === s) {
@@ -166,20 +166,27 @@ export async function formatBlockContent(view) {
   return true;
 }
 
+/**
+ * returns error message to show instead of the output of the program
+ * ErrorInfo is the same for all /api/goplay/ calls:
+ * { Phase: "format" | "build" | "run" | "timeout", Diagnostics, ExitCode, Message }
+ * @param {any} res
+ * @returns {string}
+ */
 function getError(res) {
-  // TODO: don't get why there are Error and Errors
-  // maybe can improve backend code?
-  if (res.Error && res.Error !== "") {
-    return res.Error;
+  const info = res.ErrorInfo;
+  if (!info) {
+    return "";
   }
-  if (res.Errors && res.Errors !== "") {
-    return res.Errors;
+  // output of the program that failed is more useful than the error
+  if (info.Phase === "run" && res.Events && res.Events.length > 0) {
+    return "";
   }
-  return "";
+  return info.Message;
 }
 
 async function runGo(code) {
-  const uri = "/api/goplay/compile";
+  const uri = "/api/goplay/compile?errors=v2";
   const rsp = await fetch(uri, {
     method: "POST",
     body: code,
@@ -189,12 +196,39 @@ async function runGo(code) {
   }
   const res = await rsp.json();
   //console.log("res:", res);
+  return getOutput(res);
+}
+
+/**
+ * runs code with an interpreter configured on the server
+ * @param {string} langToken
+ * @param {string} code
+ * @returns {Promise<string>}
+ */
+async function runWithServer(langToken, code) {
+  const uri = "/api/run/" + langToken;
+  const rsp = await fetch(uri, {
+    method: "POST",
+    body: code,
+  });
+  if (!rsp.ok) {
+    return `Error: ${rsp.status} ${rsp.statusText}`;
+  }
+  const res = await rsp.json();
+  return getOutput(res);
+}
+
+/**
+ * @param {any} res response of /api/goplay/compile or /api/run/${lang}
+ * @returns {string}
+ */
+function getOutput(res) {
   const err = getError(res);
   if (err != "") {
     return err;
   }
   let s = "";
-  for (const ev of res.Events) {
+  for (const ev of res.Events || []) {
     if (s !== "") {
       s += "\n";
     }
@@ -222,30 +256,30 @@ export async function runBlockContent(view) {
 
   const content = state.sliceDoc(block.content.from, block.content.to);
 
-  let output = "";
-  if (lang.token == "golang") {
-    // formatGo() is async so we need to prevent changes to the state of the editor
-    // we make it read-only
-    // TODO: maybe show some indication that we're doing an operation
-    let s;
-    try {
-      editor.setReadOnly(true);
-      s = await runGo(content);
-    } catch (e) {
-      console.log("error formatting go:", e);
-      return false;
-    } finally {
-      editor.setReadOnly(false);
+  // running is async so we need to prevent changes to the state of the editor
+  // we make it read-only
+  // TODO: maybe show some indication that we're doing an operation
+  let output;
+  try {
+    editor.setReadOnly(true);
+    if (lang.token == "golang") {
+      output = await runGo(content);
+    } else {
+      output = await runWithServer(lang.token, content);
     }
+  } catch (e) {
+    console.log("error running code:", e);
+    return false;
+  } finally {
+    editor.setReadOnly(false);
+  }
 
-    if (!s) {
-      console.log("failed to run go");
-      return false;
-    }
-    output = s;
+  if (!output) {
+    console.log("failed to run code");
+    return false;
   }
 
-  console.log("output of running go:", output);
+  console.log("output of running the code:", output);
   // const block = getActiveNoteBlock(state)
   const delimText = "\n∞∞∞text-a\n" + "output of running the code:\n" + output;
 
@@ -230,6 +230,26 @@ export function getLanguageNameFromToken(token) {
   return lang ? lang.name : "Unknown";
 }
 
+/**
+ * tokens of languages the server can run with /api/run/${token}
+ * @type {string[]}
+ */
+let serverRunLanguages = [];
+
+export async function loadServerRunLanguages() {
+  try {
+    const rsp = await fetch("/api/run/languages");
+    if (!rsp.ok) {
+      return;
+    }
+    const res = await rsp.json();
+    serverRunLanguages = res.Languages;
+    console.log("server can run:", serverRunLanguages);
+  } catch (e) {
+    console.log("loadServerRunLanguages: failed with", e);
+  }
+}
+
 /**
  * @param {Language} lang
  * @returns {boolean}
@@ -241,7 +261,7 @@ export function langSupportsRun(lang) {
   if (lang.token === "golang") {
     return true;
   }
-  return false;
+  return serverRunLanguages.includes(lang.token);
 }
 
 // TODO: should be async to support on-demand loading of parsers
@@ -384,6 +384,25 @@ export async function createNewScratchNote() {
   return scratchName;
 }
 
+/**
+ * creates a new note with Go snippet shared via /api/goplay/share
+ * @param {string} id
+ * @returns {Promise<string>} name of the note or null if failed to load the snippet
+ */
+export async function createNoteFromGoSnippet(id) {
+  console.log("createNoteFromGoSnippet:", id);
+  const rsp = await fetch("/api/goplay/load?" + encodeURIComponent(id));
+  if (!rsp.ok) {
+    console.log("failed to load snippet", id, rsp.status);
+    return null;
+  }
+  let code = await rsp.text();
+  let noteNames = await loadNoteNames();
+  let name = pickUniqueNameInNoteNames("go-" + id, noteNames);
+  await createNoteWithName(name, "\n∞∞∞golang\n" + code);
+  return name;
+}
+
 /**
  * @param {string} name
  * @param {string} content
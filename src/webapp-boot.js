@@ -3,6 +3,7 @@ import "./css/application.sass";
 
 import {
   createDefaultNotes,
+  createNoteFromGoSnippet,
   dbGetDirHandle,
   getLatestNoteNames,
   isSystemNoteName,
@@ -22,10 +23,12 @@ import Toast from "vue-toastification/dist/index.mjs";
 import { createApp } from "vue";
 import { hasHandlePermission } from "./fileutil";
 import { startLoadCurrencies } from "./currency";
+import { loadServerRunLanguages } from "./editor/languages";
 
 /** @typedef {import("./settings").Settings} Settings */
 
 startLoadCurrencies();
+loadServerRunLanguages();
 
 let app;
 
@@ -64,8 +67,18 @@ export async function boot() {
   hashName = decodeURIComponent(hashName);
   let settingsName = settings.currentNoteName;
 
-  // re-do because could have created default notes
-  if (len(createdNotes) > 0) {
+  // /s/${id} redirects to /?snippet=${id}
+  let snippetID = new URLSearchParams(window.location.search).get("snippet");
+  if (snippetID) {
+    let name = await createNoteFromGoSnippet(snippetID);
+    if (name) {
+      hashName = name;
+    }
+    window.history.replaceState(null, "", "/");
+  }
+
+  // re-do because could have created default notes or a note from snippet
+  if (len(createdNotes) > 0 || snippetID) {
     noteNames = await loadNoteNames();
   }
 